@@ -0,0 +1,720 @@
+// Package boltcache provides an httpcache.Cache that stores resources in a
+// single bolt database file
+package boltcache
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lox/httpcache"
+	"github.com/lox/httpcache/internal/lru"
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltChunkSize is the size of the chunks that bodies are stored in, so that
+// large bodies can be streamed in and out without holding them in memory
+const boltChunkSize = 1 << 20
+
+var (
+	entriesBucket = []byte("entries")
+	bodiesBucket  = []byte("bodies")
+)
+
+var errBoltBodyMissing = errors.New("body missing from bolt cache")
+
+// boltCache is a Cache that stores resources in a single bolt database file.
+//
+// Each key has a record in the entries bucket holding the id of its body, the
+// length of the body and the serialized headers. Bodies are nested buckets in
+// the bodies bucket, holding the body in chunks keyed by their index. A body
+// that's replaced or evicted while it's being read is only deleted once its
+// last reader is closed.
+type boltCache struct {
+	db  *bolt.DB
+	lru *lru.LRU
+
+	bodiesMu   sync.Mutex
+	openBodies map[string]int
+	deadBodies map[string]bool
+}
+
+var (
+	_ httpcache.Cache      = (*boltCache)(nil)
+	_ httpcache.StatsCache = (*boltCache)(nil)
+)
+
+// New returns a cache backend stored in the bolt database at path, which is
+// created if it doesn't exist
+func New(path string) (httpcache.Cache, error) {
+	return NewLimited(path, 0, 0)
+}
+
+// NewLimited returns a cache backend stored in a bolt database, limited in size
+// as per httpcache.NewLimitedVFSCache. Resources already in the database count
+// towards the limits.
+func NewLimited(path string, maxBytes int64, maxEntries int) (httpcache.Cache, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{entriesBucket, bodiesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	c := &boltCache{
+		db:         db,
+		lru:        lru.New(maxBytes, maxEntries),
+		openBodies: map[string]int{},
+		deadBodies: map[string]bool{},
+	}
+	if err := c.loadIndex(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Stats returns the number and size of the resources in the cache and how many
+// have been evicted
+func (c *boltCache) Stats() httpcache.CacheStats {
+	return httpcache.CacheStats(c.lru.Stats())
+}
+
+// Close closes the underlying database
+func (c *boltCache) Close() error {
+	return c.db.Close()
+}
+
+// boltEntry is the record stored for each key
+type boltEntry struct {
+	bodyID string
+	length int64
+	header []byte
+}
+
+const boltEntryPrefixLen = 32 + 8
+
+func (e boltEntry) encode() []byte {
+	b := make([]byte, boltEntryPrefixLen, boltEntryPrefixLen+len(e.header))
+	copy(b, e.bodyID)
+	binary.BigEndian.PutUint64(b[32:], uint64(e.length))
+	return append(b, e.header...)
+}
+
+func decodeBoltEntry(b []byte) (boltEntry, error) {
+	if len(b) < boltEntryPrefixLen {
+		return boltEntry{}, fmt.Errorf("malformed bolt cache entry of %d bytes", len(b))
+	}
+	return boltEntry{
+		bodyID: string(b[:32]),
+		length: int64(binary.BigEndian.Uint64(b[32:boltEntryPrefixLen])),
+		header: append([]byte(nil), b[boltEntryPrefixLen:]...),
+	}, nil
+}
+
+// record decodes the header record of the entry
+func (e boltEntry) record() (httpcache.Record, error) {
+	return httpcache.ReadRecord(bufio.NewReader(bytes.NewReader(e.header)))
+}
+
+func (e boltEntry) size() int64 {
+	return int64(len(e.header)) + e.length
+}
+
+func chunkKey(idx int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(idx))
+	return b
+}
+
+// loadIndex adds the entries already in the database to the lru, and removes
+// any bodies left behind by writers that were never closed
+func (c *boltCache) loadIndex() error {
+	type indexed struct {
+		hash string
+		size int64
+		date time.Time
+	}
+	var entries []indexed
+
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		used := map[string]bool{}
+
+		err := tx.Bucket(entriesBucket).ForEach(func(k, v []byte) error {
+			e, err := decodeBoltEntry(v)
+			if err != nil {
+				return err
+			}
+			used[e.bodyID] = true
+
+			var date time.Time
+			if rec, err := e.record(); err == nil {
+				date, _ = http.ParseTime(rec.Get("Date"))
+			}
+			entries = append(entries, indexed{string(k), e.size(), date})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		var orphans [][]byte
+		bodies := tx.Bucket(bodiesBucket)
+		err = bodies.ForEach(func(k, v []byte) error {
+			if !used[string(k)] {
+				orphans = append(orphans, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range orphans {
+			debugf("removing orphaned body %s", k)
+			if err := bodies.DeleteBucket(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].date.Before(entries[j].date)
+	})
+
+	for _, e := range entries {
+		c.evict(c.lru.Add(e.hash, e.size))
+	}
+	return nil
+}
+
+// evict removes the entries and the bodies of resources by hashed key. Entries
+// are added to the lru in the same transaction that stores them, so one that
+// has been stored again since it was chosen for eviction is still tracked and
+// isn't removed.
+func (c *boltCache) evict(hashes []string) {
+	for _, hash := range hashes {
+		var bodyID string
+		err := c.db.Update(func(tx *bolt.Tx) error {
+			if c.lru.Has(hash) {
+				debugf("not evicting %s, it was stored again", hash)
+				return nil
+			}
+			debugf("evicting %s", hash)
+			var err error
+			bodyID, err = deleteBoltEntry(tx, []byte(hash))
+			return err
+		})
+		if err != nil {
+			errorf("Error evicting %s: %s", hash, err.Error())
+			continue
+		}
+		c.dropBodies(bodyID)
+	}
+}
+
+// deleteBoltEntry removes the entry for a hashed key and returns the id of its
+// body, which is passed to dropBodies once the transaction is committed
+func deleteBoltEntry(tx *bolt.Tx, hash []byte) (string, error) {
+	entries := tx.Bucket(entriesBucket)
+	v := entries.Get(hash)
+	if v == nil {
+		return "", nil
+	}
+	e, err := decodeBoltEntry(v)
+	if err != nil {
+		return "", err
+	}
+	return e.bodyID, entries.Delete(hash)
+}
+
+// openBody returns the entry for a key with its body marked as being read, so
+// that it isn't deleted until closeBody is called
+func (c *boltCache) openBody(key string) (boltEntry, error) {
+	c.bodiesMu.Lock()
+	defer c.bodiesMu.Unlock()
+
+	e, err := c.entry(key)
+	if err != nil {
+		return e, err
+	}
+	if c.deadBodies[e.bodyID] {
+		return boltEntry{}, httpcache.ErrNotFoundInCache
+	}
+	c.openBodies[e.bodyID]++
+	return e, nil
+}
+
+// closeBody marks a body as no longer being read by one reader, deleting it if
+// it was dropped while it was being read
+func (c *boltCache) closeBody(bodyID string) {
+	c.bodiesMu.Lock()
+	c.openBodies[bodyID]--
+	unread := c.openBodies[bodyID] <= 0
+	if unread {
+		delete(c.openBodies, bodyID)
+	}
+	dead := unread && c.deadBodies[bodyID]
+	c.bodiesMu.Unlock()
+
+	if dead {
+		c.deleteBodies(bodyID)
+	}
+}
+
+// dropBodies deletes the bodies of entries that have been removed, or defers
+// deleting them until their readers are closed
+func (c *boltCache) dropBodies(bodyIDs ...string) {
+	var unread []string
+
+	c.bodiesMu.Lock()
+	for _, bodyID := range bodyIDs {
+		if bodyID == "" {
+			continue
+		}
+		c.deadBodies[bodyID] = true
+		if c.openBodies[bodyID] > 0 {
+			debugf("deferring deleting body %s until it's read", bodyID)
+		} else {
+			unread = append(unread, bodyID)
+		}
+	}
+	c.bodiesMu.Unlock()
+
+	c.deleteBodies(unread...)
+}
+
+// deleteBodies deletes dead bodies from the database. They stay marked as dead
+// until they're deleted, so that they can't be opened while they're deleted,
+// but bodiesMu isn't held during the transaction.
+func (c *boltCache) deleteBodies(bodyIDs ...string) {
+	if len(bodyIDs) == 0 {
+		return
+	}
+
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		bodies := tx.Bucket(bodiesBucket)
+		for _, bodyID := range bodyIDs {
+			if err := bodies.DeleteBucket([]byte(bodyID)); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		errorf("Error deleting bodies %q: %s", bodyIDs, err.Error())
+	}
+
+	c.bodiesMu.Lock()
+	for _, bodyID := range bodyIDs {
+		delete(c.deadBodies, bodyID)
+	}
+	c.bodiesMu.Unlock()
+}
+
+func (c *boltCache) entry(key string) (boltEntry, error) {
+	var e boltEntry
+
+	err := c.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(entriesBucket).Get([]byte(hashKey(key)))
+		if v == nil {
+			return httpcache.ErrNotFoundInCache
+		}
+		var err error
+		e, err = decodeBoltEntry(v)
+		return err
+	})
+
+	return e, err
+}
+
+// Retrieve the Status and Headers for a given key path
+func (c *boltCache) Header(key string) (httpcache.Header, error) {
+	e, err := c.entry(key)
+	if err != nil {
+		return httpcache.Header{}, err
+	}
+
+	rec, err := e.record()
+	return rec.Header, err
+}
+
+// Store a resource against a number of keys
+func (c *boltCache) Store(res *httpcache.Resource, keys ...string) error {
+	w, err := c.Writer(res.Status(), res.Header(), keys...)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(w, res); err != nil {
+		w.Abort()
+		return err
+	}
+
+	return w.Close()
+}
+
+// Writer returns a ResourceWriter that streams a body into chunks in the
+// database, which are attached to each key when it's closed
+func (c *boltCache) Writer(statusCode int, h http.Header, keys ...string) (httpcache.ResourceWriter, error) {
+	bodyID := tempName()
+
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.Bucket(bodiesBucket).CreateBucket([]byte(bodyID))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	length := int64(-1)
+	if cl, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil {
+		length = cl
+	}
+
+	return &boltResourceWriter{
+		cache:      c,
+		bodyID:     bodyID,
+		keys:       keys,
+		statusCode: statusCode,
+		header:     h.Clone(),
+		length:     length,
+		buf:        make([]byte, 0, boltChunkSize),
+	}, nil
+}
+
+// Retrieve returns a cached Resource for the given key
+func (c *boltCache) Retrieve(key string) (*httpcache.Resource, error) {
+	e, err := c.openBody(key)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := e.record()
+	if err != nil {
+		c.closeBody(e.bodyID)
+		return nil, err
+	}
+	c.lru.Touch(hashKey(key))
+
+	return rec.Resource(&boltBody{cache: c, bodyID: e.bodyID, length: e.length}), nil
+}
+
+// Invalidate marks the resources stored for the keys as stale
+func (c *boltCache) Invalidate(keys ...string) {
+	debugf("invalidating %q", keys)
+
+	for _, key := range keys {
+		err := c.updateRecord(key, func(rec *httpcache.Record) {
+			rec.Invalidate()
+		})
+		if err != nil && err != httpcache.ErrNotFoundInCache {
+			errorf("Error invalidating %s: %s", key, err.Error())
+		}
+	}
+}
+
+func (c *boltCache) Freshen(res *httpcache.Resource, keys ...string) error {
+	for _, key := range keys {
+		err := c.updateRecord(key, func(rec *httpcache.Record) {
+			if rec.Freshen(res) {
+				debugf("freshening key %s", key)
+			} else {
+				debugf("freshen failed, invalidating %s", key)
+			}
+		})
+		if err != nil && err != httpcache.ErrNotFoundInCache {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateRecord replaces the header record of an existing entry with the
+// result of f in a single transaction, keeping its body
+func (c *boltCache) updateRecord(key string, f func(rec *httpcache.Record)) error {
+	hash := []byte(hashKey(key))
+	var evicted []string
+
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(entriesBucket)
+		v := entries.Get(hash)
+		if v == nil {
+			return httpcache.ErrNotFoundInCache
+		}
+		e, err := decodeBoltEntry(v)
+		if err != nil {
+			return err
+		}
+		rec, err := e.record()
+		if err != nil {
+			return err
+		}
+		f(&rec)
+		e.header = rec.Bytes()
+		if err := entries.Put(hash, e.encode()); err != nil {
+			return err
+		}
+		evicted = c.lru.Add(string(hash), e.size())
+		return nil
+	})
+	c.evict(evicted)
+	return err
+}
+
+// boltResourceWriter is a ResourceWriter for the bolt cache
+type boltResourceWriter struct {
+	cache      *boltCache
+	bodyID     string
+	keys       []string
+	statusCode int
+	header     http.Header
+	length     int64
+	written    int64
+	chunks     int64
+	buf        []byte
+}
+
+func (w *boltResourceWriter) Write(b []byte) (int, error) {
+	var n int
+
+	for len(b) > 0 {
+		c := copy(w.buf[len(w.buf):cap(w.buf)], b)
+		w.buf = w.buf[:len(w.buf)+c]
+		b = b[c:]
+		n += c
+		w.written += int64(c)
+
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// flush writes the buffered chunk to the database
+func (w *boltResourceWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	err := w.cache.db.Update(func(tx *bolt.Tx) error {
+		body := tx.Bucket(bodiesBucket).Bucket([]byte(w.bodyID))
+		if body == nil {
+			return errBoltBodyMissing
+		}
+		return body.Put(chunkKey(w.chunks), w.buf)
+	})
+	if err != nil {
+		return err
+	}
+
+	w.chunks++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close commits the body written and the headers for each of the keys in a
+// single transaction
+func (w *boltResourceWriter) Close() error {
+	if err := w.flush(); err != nil {
+		w.Abort()
+		return err
+	}
+
+	if w.length != -1 && w.length != w.written {
+		w.Abort()
+		return fmt.Errorf("body of %d bytes doesn't match Content-Length of %d",
+			w.written, w.length)
+	}
+
+	header := httpcache.Record{
+		Header:     httpcache.Header{Header: w.header, StatusCode: w.statusCode},
+		BodyLength: w.written,
+	}.Bytes()
+	var evicted, replaced []string
+
+	err := w.cache.db.Update(func(tx *bolt.Tx) error {
+		bodies := tx.Bucket(bodiesBucket)
+		entries := tx.Bucket(entriesBucket)
+
+		for idx, key := range w.keys {
+			hash := hashKey(key)
+			old, err := deleteBoltEntry(tx, []byte(hash))
+			if err != nil {
+				return err
+			}
+			replaced = append(replaced, old)
+
+			bodyID := w.bodyID
+			if idx < len(w.keys)-1 {
+				bodyID = tempName()
+				if err := copyBoltBody(bodies, w.bodyID, bodyID); err != nil {
+					return err
+				}
+			}
+
+			e := boltEntry{bodyID: bodyID, length: w.written, header: header}
+			if err := entries.Put([]byte(hash), e.encode()); err != nil {
+				return err
+			}
+			evicted = append(evicted, w.cache.lru.Add(hash, e.size())...)
+		}
+
+		if len(w.keys) == 0 {
+			return bodies.DeleteBucket([]byte(w.bodyID))
+		}
+		return nil
+	})
+	if err != nil {
+		w.Abort()
+		return err
+	}
+
+	w.cache.dropBodies(replaced...)
+	w.cache.evict(evicted)
+
+	return nil
+}
+
+// Abort discards the body written
+func (w *boltResourceWriter) Abort() error {
+	w.buf = w.buf[:0]
+
+	return w.cache.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(bodiesBucket).DeleteBucket([]byte(w.bodyID))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+// copyBoltBody copies the chunks of one body to a new body
+func copyBoltBody(bodies *bolt.Bucket, src, dest string) error {
+	from := bodies.Bucket([]byte(src))
+	if from == nil {
+		return errBoltBodyMissing
+	}
+	to, err := bodies.CreateBucket([]byte(dest))
+	if err != nil {
+		return err
+	}
+	return from.ForEach(func(k, v []byte) error {
+		return to.Put(k, v)
+	})
+}
+
+// boltBody reads a body from the database a chunk at a time, so that no read
+// transaction is held open between reads. The body isn't deleted until it's
+// closed, even if its entry is replaced or evicted.
+type boltBody struct {
+	cache  *boltCache
+	bodyID string
+	length int64
+	offset int64
+	closed bool
+}
+
+func (b *boltBody) Read(p []byte) (int, error) {
+	if b.offset >= b.length {
+		return 0, io.EOF
+	}
+
+	var n int
+	err := b.cache.db.View(func(tx *bolt.Tx) error {
+		body := tx.Bucket(bodiesBucket).Bucket([]byte(b.bodyID))
+		if body == nil {
+			return errBoltBodyMissing
+		}
+		chunk := body.Get(chunkKey(b.offset / boltChunkSize))
+		start := b.offset % boltChunkSize
+		if int64(len(chunk)) <= start {
+			return io.ErrUnexpectedEOF
+		}
+		n = copy(p, chunk[start:])
+		return nil
+	})
+
+	b.offset += int64(n)
+	return n, err
+}
+
+func (b *boltBody) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.length
+	default:
+		return 0, errors.New("boltBody.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("boltBody.Seek: negative position")
+	}
+	b.offset = offset
+	return offset, nil
+}
+
+func (b *boltBody) Close() error {
+	if !b.closed {
+		b.closed = true
+		b.cache.closeBody(b.bodyID)
+	}
+	return nil
+}
+
+func hashKey(key string) string {
+	h := sha256.New()
+	io.WriteString(h, key)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// tempName returns a random name of 32 characters, as the ids of bodies are
+func tempName() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func debugf(format string, args ...interface{}) {
+	if httpcache.DebugLogging {
+		log.Printf(format, args...)
+	}
+}
+
+func errorf(format string, args ...interface{}) {
+	log.Printf("\x1b[31;1m✗ "+format+"\x1b[0m", args...)
+}
@@ -3,7 +3,9 @@ package httpcache
 import (
 	"bufio"
 	"bytes"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -12,16 +14,19 @@ import (
 	"net/textproto"
 	"os"
 	pathutil "path"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
-	"time"
 
+	"github.com/lox/httpcache/internal/lru"
 	"github.com/rainycape/vfs"
 )
 
 const (
 	headerPrefix = "header/"
 	bodyPrefix   = "body/"
+	tempPrefix   = "tmp/"
 	formatPrefix = "v1/"
 )
 
@@ -31,18 +36,44 @@ var ErrNotFoundInCache = errors.New("Not found in cache")
 type Cache interface {
 	Header(key string) (Header, error)
 	Store(res *Resource, keys ...string) error
+	Writer(statusCode int, h http.Header, keys ...string) (ResourceWriter, error)
 	Retrieve(key string) (*Resource, error)
 	Invalidate(keys ...string)
 	Freshen(res *Resource, keys ...string) error
 }
 
-// cache provides a storage mechanism for cached Resources
+// StatsCache is implemented by a Cache that reports statistics about what it holds
+type StatsCache interface {
+	Stats() CacheStats
+}
+
+// CacheStats are the statistics reported by a StatsCache
+type CacheStats struct {
+	Entries   int64
+	Bytes     int64
+	Evictions int64
+}
+
+// ResourceWriter streams the body of a resource into a Cache. Nothing is
+// visible in the cache until Close commits the resource, Abort discards it.
+type ResourceWriter interface {
+	io.WriteCloser
+	Abort() error
+}
+
+// cache provides a storage mechanism for cached Resources. It's safe for
+// concurrent use, the header and body of a key are read and written under a
+// lock for that key so that readers never see them from different writes.
 type cache struct {
 	fs    vfs.VFS
-	stale map[string]time.Time
+	lru   *lru.LRU
+	locks *keyLocks
 }
 
-var _ Cache = (*cache)(nil)
+var (
+	_ Cache      = (*cache)(nil)
+	_ StatsCache = (*cache)(nil)
+)
 
 type Header struct {
 	http.Header
@@ -51,7 +82,26 @@ type Header struct {
 
 // NewCache returns a cache backend off the provided VFS
 func NewVFSCache(fs vfs.VFS) Cache {
-	return &cache{fs: fs, stale: map[string]time.Time{}}
+	return NewLimitedVFSCache(fs, 0, 0)
+}
+
+// NewLimitedVFSCache returns a cache backend off the provided VFS that evicts
+// the least recently used resources once it holds more than maxBytes or more
+// than maxEntries. A limit of zero means no limit.
+func NewLimitedVFSCache(fs vfs.VFS, maxBytes int64, maxEntries int) Cache {
+	c := &cache{
+		fs:    fs,
+		lru:   lru.New(maxBytes, maxEntries),
+		locks: newKeyLocks(),
+	}
+	c.loadIndex()
+	return c
+}
+
+// Stats returns the number and size of the resources in the cache and how many
+// have been evicted
+func (c *cache) Stats() CacheStats {
+	return CacheStats(c.lru.Stats())
 }
 
 // NewMemoryCache returns an ephemeral cache in memory
@@ -59,8 +109,20 @@ func NewMemoryCache() Cache {
 	return NewVFSCache(vfs.Memory())
 }
 
+// NewLimitedMemoryCache returns an ephemeral cache in memory, limited in size
+// as per NewLimitedVFSCache
+func NewLimitedMemoryCache(maxBytes int64, maxEntries int) Cache {
+	return NewLimitedVFSCache(vfs.Memory(), maxBytes, maxEntries)
+}
+
 // NewDiskCache returns a disk-backed cache
 func NewDiskCache(dir string) (Cache, error) {
+	return NewLimitedDiskCache(dir, 0, 0)
+}
+
+// NewLimitedDiskCache returns a disk-backed cache, limited in size as per
+// NewLimitedVFSCache. Resources already on disk count towards the limits.
+func NewLimitedDiskCache(dir string, maxBytes int64, maxEntries int) (Cache, error) {
 	if err := os.MkdirAll(dir, 0777); err != nil {
 		return nil, err
 	}
@@ -72,133 +134,495 @@ func NewDiskCache(dir string) (Cache, error) {
 	if err != nil {
 		return nil, err
 	}
-	return NewVFSCache(chfs), nil
+	return NewLimitedVFSCache(&diskFS{VFS: chfs, root: dir}, maxBytes, maxEntries), nil
+}
+
+// renamer is implemented by a vfs.VFS that can rename files atomically
+type renamer interface {
+	Rename(oldpath, newpath string) error
+}
+
+// diskFS is a vfs.VFS on disk that supports renaming files
+type diskFS struct {
+	vfs.VFS
+	root string
+}
+
+func (fs *diskFS) Rename(oldpath, newpath string) error {
+	return os.Rename(fs.path(oldpath), fs.path(newpath))
+}
+
+func (fs *diskFS) path(name string) string {
+	return filepath.Join(fs.root, filepath.FromSlash(pathutil.Clean("/"+name)))
+}
+
+// loadIndex adds resources that already exist in the VFS to the lru, oldest
+// first, and removes any temporary files left behind by interrupted writes
+func (c *cache) loadIndex() {
+	if tmps, err := c.fs.ReadDir(tempPrefix); err == nil {
+		for _, info := range tmps {
+			debugf("removing temporary file %s", info.Name())
+			if err := c.fs.Remove(tempPrefix + info.Name()); err != nil {
+				errorf("Error removing %s: %s", info.Name(), err.Error())
+			}
+		}
+	}
+
+	infos, err := c.fs.ReadDir(headerPrefix + formatPrefix)
+	if err != nil {
+		if !vfs.IsNotExist(err) {
+			errorf("Error reading cache index: %s", err.Error())
+		}
+		return
+	}
+
+	sort.Sort(byModTime(infos))
+
+	for _, info := range infos {
+		unlock := c.locks.lock(info.Name())
+		evicted := c.track(info.Name())
+		unlock()
+		c.evict(evicted)
+	}
+}
+
+// track records the size of the resource stored under a hashed key. It must be
+// called with the key's lock held, so that it's ordered with evictions. It
+// returns the hashed keys of resources that no longer fit in the cache, which
+// are passed to evict once the lock is released.
+func (c *cache) track(hash string) []string {
+	var size int64
+
+	for _, path := range []string{headerPrefix + formatPrefix + hash, bodyPrefix + formatPrefix + hash} {
+		info, err := c.fs.Stat(path)
+		if err != nil {
+			debugf("error tracking %s: %s", path, err.Error())
+			return nil
+		}
+		size += info.Size()
+	}
+
+	return c.lru.Add(hash, size)
+}
+
+// evict removes both the header and the body of resources by hashed key, unless
+// they've been stored again since they were chosen for eviction
+func (c *cache) evict(hashes []string) {
+	for _, hash := range hashes {
+		c.evictHash(hash)
+	}
+}
+
+func (c *cache) evictHash(hash string) {
+	unlock := c.locks.lock(hash)
+	defer unlock()
+
+	if c.lru.Has(hash) {
+		debugf("not evicting %s, it was stored again", hash)
+		return
+	}
+
+	debugf("evicting %s", hash)
+	for _, path := range []string{headerPrefix + formatPrefix + hash, bodyPrefix + formatPrefix + hash} {
+		if err := c.fs.Remove(path); err != nil && !vfs.IsNotExist(err) {
+			errorf("Error evicting %s: %s", path, err.Error())
+		}
+	}
 }
 
+// vfsWrite writes a file to a temporary path and renames it into place, so
+// that readers never see it partially written. If the VFS doesn't support
+// renaming the file is written in place.
 func (c *cache) vfsWrite(path string, r io.Reader) error {
-	if err := vfs.MkdirAll(c.fs, pathutil.Dir(path), 0700); err != nil {
+	fs, ok := c.fs.(renamer)
+	if !ok {
+		return c.writeFile(path, r)
+	}
+
+	tmp := tempPrefix + tempName()
+	if err := c.writeFile(tmp, r); err != nil {
+		c.fs.Remove(tmp)
+		return err
+	}
+	if err := c.mkdirAll(pathutil.Dir(path)); err != nil {
+		c.fs.Remove(tmp)
+		return err
+	}
+	if err := fs.Rename(tmp, path); err != nil {
+		c.fs.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// mkdirAll creates a directory and its parents, tolerating them being created
+// concurrently by another writer
+func (c *cache) mkdirAll(dir string) error {
+	err := vfs.MkdirAll(c.fs, dir, 0700)
+	if err != nil && vfs.IsExist(err) {
+		err = vfs.MkdirAll(c.fs, dir, 0700)
+	}
+	return err
+}
+
+func (c *cache) writeFile(path string, r io.Reader) error {
+	if err := c.mkdirAll(pathutil.Dir(path)); err != nil {
 		return err
 	}
 	f, err := c.fs.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
 		return err
 	}
-	return nil
+	return syncClose(f)
 }
 
-// Retrieve the Status and Headers for a given key path
-func (c *cache) Header(key string) (Header, error) {
-	path := headerPrefix + formatPrefix + hashKey(key)
+// syncClose flushes a file to stable storage if the VFS supports it, then closes it
+func syncClose(f vfs.WFile) error {
+	if s, ok := f.(interface {
+		Sync() error
+	}); ok {
+		if err := s.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// open opens a file for reading. The files of the in-memory VFS write back the
+// data they were opened with when they're closed, even if they're read only,
+// which would undo any write made since, so they're never closed.
+func (c *cache) open(path string) (vfs.RFile, error) {
 	f, err := c.fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := f.(interface {
+		SetCompressed(bool)
+	}); ok {
+		return memoryFile{f}, nil
+	}
+	return f, nil
+}
+
+// memoryFile is a file of the in-memory VFS that isn't closed
+type memoryFile struct {
+	vfs.RFile
+}
+
+func (f memoryFile) Close() error {
+	return nil
+}
+
+// readRecord reads the header file for a key
+func (c *cache) readRecord(key string) (Record, error) {
+	f, err := c.open(headerPrefix + formatPrefix + hashKey(key))
 	if err != nil {
 		if vfs.IsNotExist(err) {
-			return Header{}, ErrNotFoundInCache
+			return Record{}, ErrNotFoundInCache
 		}
+		return Record{}, err
+	}
+	defer f.Close()
+
+	return ReadRecord(bufio.NewReader(f))
+}
+
+// Retrieve the Status and Headers for a given key path
+func (c *cache) Header(key string) (Header, error) {
+	unlock := c.locks.rlock(hashKey(key))
+	defer unlock()
+
+	rec, err := c.readRecord(key)
+	if err != nil {
 		return Header{}, err
 	}
 
-	return readHeaders(bufio.NewReader(f))
+	return rec.Header, nil
 }
 
 // Store a resource against a number of keys
 func (c *cache) Store(res *Resource, keys ...string) error {
-	var buf = &bytes.Buffer{}
+	w, err := c.Writer(res.Status(), res.Header(), keys...)
+	if err != nil {
+		return err
+	}
 
-	if length, err := strconv.ParseInt(res.Header().Get("Content-Length"), 10, 64); err == nil {
-		if _, err = io.CopyN(buf, res, length); err != nil {
-			return err
-		}
-	} else if _, err = io.Copy(buf, res); err != nil {
+	if _, err = io.Copy(w, res); err != nil {
+		w.Abort()
 		return err
 	}
 
-	for _, key := range keys {
-		delete(c.stale, key)
+	return w.Close()
+}
 
-		if err := c.storeBody(buf, key); err != nil {
-			return err
-		}
+// Writer returns a ResourceWriter that streams a body into a temporary file,
+// which is moved into place for each key when it's closed
+func (c *cache) Writer(statusCode int, h http.Header, keys ...string) (ResourceWriter, error) {
+	path := tempPrefix + tempName()
+	if err := c.mkdirAll(pathutil.Dir(path)); err != nil {
+		return nil, err
+	}
+
+	f, err := c.fs.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
 
-		if err := c.storeHeader(res.Status(), res.Header(), key); err != nil {
+	length := int64(-1)
+	if cl, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil {
+		length = cl
+	}
+
+	return &resourceWriter{
+		cache:      c,
+		file:       f,
+		path:       path,
+		keys:       keys,
+		statusCode: statusCode,
+		header:     cloneHeader(h),
+		length:     length,
+	}, nil
+}
+
+// moveBody moves the body at path to the body for key, falling back to copying
+// it if the VFS doesn't support renaming. Bodies are moved into place before
+// their header, and Retrieve checks the length recorded in the header to catch
+// a header paired with the wrong body.
+func (c *cache) moveBody(path, key string) error {
+	dest := bodyPrefix + formatPrefix + hashKey(key)
+
+	if r, ok := c.fs.(renamer); ok {
+		if err := c.mkdirAll(pathutil.Dir(dest)); err != nil {
 			return err
 		}
+		return r.Rename(path, dest)
 	}
 
-	return nil
+	if err := c.copyBody(path, key); err != nil {
+		return err
+	}
+	return c.fs.Remove(path)
 }
 
-func (c *cache) storeBody(r io.Reader, key string) error {
-	if err := c.vfsWrite(bodyPrefix+formatPrefix+hashKey(key), r); err != nil {
+// copyBody copies the body at path to the body for key
+func (c *cache) copyBody(path, key string) error {
+	f, err := c.open(path)
+	if err != nil {
 		return err
 	}
-	return nil
+	defer f.Close()
+
+	return c.vfsWrite(bodyPrefix+formatPrefix+hashKey(key), f)
 }
 
-func (c *cache) storeHeader(code int, h http.Header, key string) error {
-	hb := &bytes.Buffer{}
-	hb.Write([]byte(fmt.Sprintf("HTTP/1.1 %d %s\r\n", code, http.StatusText(code))))
-	headersToWriter(h, hb)
+// storeRecord writes the header file for a key
+func (c *cache) storeRecord(rec Record, key string) error {
+	return c.vfsWrite(headerPrefix+formatPrefix+hashKey(key), bytes.NewReader(rec.Bytes()))
+}
 
-	if err := c.vfsWrite(headerPrefix+formatPrefix+hashKey(key), bytes.NewReader(hb.Bytes())); err != nil {
-		return err
+// Retrieve returns a cached Resource for the given key. If the body doesn't
+// have the length recorded in the header, it's treated as not found.
+func (c *cache) Retrieve(key string) (*Resource, error) {
+	res, err := c.retrieve(key)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+
+	c.lru.Touch(hashKey(key))
+	return res, nil
 }
 
-// Retrieve returns a cached Resource for the given key
-func (c *cache) Retrieve(key string) (*Resource, error) {
-	f, err := c.fs.Open(bodyPrefix + formatPrefix + hashKey(key))
+// retrieve opens the body and reads the header for a key under its read lock,
+// the body stays readable after the lock is released
+func (c *cache) retrieve(key string) (*Resource, error) {
+	unlock := c.locks.rlock(hashKey(key))
+	defer unlock()
+
+	f, err := c.open(bodyPrefix + formatPrefix + hashKey(key))
 	if err != nil {
 		if vfs.IsNotExist(err) {
 			return nil, ErrNotFoundInCache
 		}
 		return nil, err
 	}
-	h, err := c.Header(key)
+	rec, err := c.readRecord(key)
 	if err != nil {
-		if vfs.IsNotExist(err) {
-			return nil, ErrNotFoundInCache
-		}
+		f.Close()
 		return nil, err
 	}
-	res := NewResource(h.StatusCode, f, h.Header)
-	if staleTime, exists := c.stale[key]; exists {
-		if !res.DateAfter(staleTime) {
-			log.Printf("stale marker of %s found", staleTime)
-			res.MarkStale()
-		}
+	length, err := f.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
 	}
-	return res, nil
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length != rec.BodyLength {
+		debugf("body of %s is %d bytes, expected %d", key, length, rec.BodyLength)
+		f.Close()
+		return nil, ErrNotFoundInCache
+	}
+	return rec.Resource(f), nil
 }
 
+// Invalidate marks the resources stored for the keys as stale, the marker is
+// stored in their header files so that it survives a restart
 func (c *cache) Invalidate(keys ...string) {
 	log.Printf("invalidating %q", keys)
+
 	for _, key := range keys {
-		c.stale[key] = Clock()
+		if err := c.invalidate(key); err != nil && err != ErrNotFoundInCache {
+			errorf("Error invalidating %s: %s", key, err.Error())
+		}
 	}
 }
 
+func (c *cache) invalidate(key string) error {
+	unlock := c.locks.lock(hashKey(key))
+	defer unlock()
+
+	rec, err := c.readRecord(key)
+	if err != nil {
+		return err
+	}
+
+	rec.Invalidate()
+	return c.storeRecord(rec, key)
+}
+
 func (c *cache) Freshen(res *Resource, keys ...string) error {
 	for _, key := range keys {
-		if h, err := c.Header(key); err == nil {
-			if h.StatusCode == res.Status() && headersEqual(h.Header, res.Header()) {
-				debugf("freshening key %s", key)
-				if err := c.storeHeader(h.StatusCode, res.Header(), key); err != nil {
-					return err
-				}
-			} else {
-				debugf("freshen failed, invalidating %s", key)
-				c.Invalidate(key)
-			}
+		evicted, err := c.freshen(res, key)
+		c.evict(evicted)
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+// freshen replaces the headers stored for a key under its lock, it returns the
+// resources to evict now that the headers have changed size
+func (c *cache) freshen(res *Resource, key string) ([]string, error) {
+	unlock := c.locks.lock(hashKey(key))
+	defer unlock()
+
+	rec, err := c.readRecord(key)
+	if err != nil {
+		return nil, nil
+	}
+
+	if !rec.Freshen(res) {
+		debugf("freshen failed, invalidating %s", key)
+		return nil, c.storeRecord(rec, key)
+	}
+
+	debugf("freshening key %s", key)
+	if err := c.storeRecord(rec, key); err != nil {
+		return nil, err
+	}
+	return c.track(hashKey(key)), nil
+}
+
+// resourceWriter is a ResourceWriter for the VFS cache
+type resourceWriter struct {
+	cache      *cache
+	file       vfs.WFile
+	path       string
+	keys       []string
+	statusCode int
+	header     http.Header
+	length     int64
+	written    int64
+}
+
+func (w *resourceWriter) Write(b []byte) (int, error) {
+	n, err := w.file.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// Close commits the body written and the headers for each of the keys
+func (w *resourceWriter) Close() error {
+	if err := syncClose(w.file); err != nil {
+		w.cache.fs.Remove(w.path)
+		return err
+	}
+
+	if w.length != -1 && w.length != w.written {
+		w.cache.fs.Remove(w.path)
+		return fmt.Errorf("body of %d bytes doesn't match Content-Length of %d",
+			w.written, w.length)
+	}
+
+	for idx, key := range w.keys {
+		evicted, err := w.commit(key, idx == len(w.keys)-1)
+		if err != nil {
+			w.cache.fs.Remove(w.path)
+			return err
+		}
+
+		w.cache.evict(evicted)
+	}
+
+	return nil
+}
+
+// commit stores the body and headers for a key and tracks them under its lock,
+// moving the body rather than copying it if it's the last key. It returns the
+// resources to evict to make room.
+func (w *resourceWriter) commit(key string, last bool) ([]string, error) {
+	unlock := w.cache.locks.lock(hashKey(key))
+	defer unlock()
+
+	var err error
+	if last {
+		err = w.cache.moveBody(w.path, key)
+	} else {
+		err = w.cache.copyBody(w.path, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.cache.storeRecord(Record{
+		Header:     Header{Header: w.header, StatusCode: w.statusCode},
+		BodyLength: w.written,
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return w.cache.track(hashKey(key)), nil
+}
+
+// Abort discards the body written
+func (w *resourceWriter) Abort() error {
+	w.file.Close()
+	return w.cache.fs.Remove(w.path)
+}
+
+// tempName returns a random name for a temporary file
+func tempName() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+type byModTime []os.FileInfo
+
+func (b byModTime) Len() int           { return len(b) }
+func (b byModTime) Less(i, j int) bool { return b[i].ModTime().Before(b[j].ModTime()) }
+func (b byModTime) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
 func hashKey(key string) string {
 	h := sha256.New()
 	io.WriteString(h, key)
@@ -228,6 +652,14 @@ func readHeaders(r *bufio.Reader) (Header, error) {
 	return Header{StatusCode: statusCode, Header: http.Header(mimeHeader)}, nil
 }
 
+// encodeHeader returns the status line and headers in the format read by readHeaders
+func encodeHeader(code int, h http.Header) []byte {
+	hb := &bytes.Buffer{}
+	hb.Write([]byte(fmt.Sprintf("HTTP/1.1 %d %s\r\n", code, http.StatusText(code))))
+	headersToWriter(h, hb)
+	return hb.Bytes()
+}
+
 func headersToWriter(h http.Header, w io.Writer) error {
 	if err := h.Write(w); err != nil {
 		return err
@@ -1,17 +1,73 @@
 package httpcache_test
 
 import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/lox/httpcache"
+	"github.com/lox/httpcache/boltcache"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+// cacheBackend creates a cache with the given limits, zero means no limit
+type cacheBackend func(t *testing.T, maxBytes int64, maxEntries int) httpcache.Cache
+
+var cacheBackends = map[string]cacheBackend{
+	"vfs": func(t *testing.T, maxBytes int64, maxEntries int) httpcache.Cache {
+		return httpcache.NewLimitedMemoryCache(maxBytes, maxEntries)
+	},
+	"disk": func(t *testing.T, maxBytes int64, maxEntries int) httpcache.Cache {
+		dir, err := ioutil.TempDir("", "httpcache")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+
+		cache, err := httpcache.NewLimitedDiskCache(dir, maxBytes, maxEntries)
+		require.NoError(t, err)
+		return cache
+	},
+	"bolt": func(t *testing.T, maxBytes int64, maxEntries int) httpcache.Cache {
+		dir, err := ioutil.TempDir("", "httpcache")
+		require.NoError(t, err)
+
+		cache, err := boltcache.NewLimited(filepath.Join(dir, "cache.db"), maxBytes, maxEntries)
+		require.NoError(t, err)
+
+		t.Cleanup(func() {
+			cache.(io.Closer).Close()
+			os.RemoveAll(dir)
+		})
+		return cache
+	},
+}
+
+// eachBackend runs a test against each of the Cache implementations
+func eachBackend(t *testing.T, f func(t *testing.T, newCache cacheBackend)) {
+	for name, newCache := range cacheBackends {
+		newCache := newCache
+		t.Run(name, func(t *testing.T) {
+			f(t, newCache)
+		})
+	}
+}
+
 func TestSaveResource(t *testing.T) {
+	eachBackend(t, testSaveResource)
+}
+
+func testSaveResource(t *testing.T, newCache cacheBackend) {
 	var body = strings.Repeat("llamas", 5000)
-	var cache = httpcache.NewMemoryCache()
+	var cache = newCache(t, 0, 0)
 
 	res := httpcache.NewResourceBytes(http.StatusOK, []byte(body), http.Header{
 		"Llamas": []string{"true"},
@@ -32,8 +88,12 @@ func TestSaveResource(t *testing.T) {
 }
 
 func TestSaveResourceWithIncorrectContentLength(t *testing.T) {
+	eachBackend(t, testSaveResourceWithIncorrectContentLength)
+}
+
+func testSaveResourceWithIncorrectContentLength(t *testing.T, newCache cacheBackend) {
 	var body = "llamas"
-	var cache = httpcache.NewMemoryCache()
+	var cache = newCache(t, 0, 0)
 
 	res := httpcache.NewResourceBytes(http.StatusOK, []byte(body), http.Header{
 		"Llamas":         []string{"true"},
@@ -49,3 +109,374 @@ func TestSaveResourceWithIncorrectContentLength(t *testing.T) {
 		t.Fatal("Entry shouldn't have been cached")
 	}
 }
+
+func storeString(t *testing.T, cache httpcache.Cache, key, body string) {
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte(body), http.Header{})
+	if err := cache.Store(res, key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLimitedCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	eachBackend(t, testLimitedCacheEvictsLeastRecentlyUsed)
+}
+
+func testLimitedCacheEvictsLeastRecentlyUsed(t *testing.T, newCache cacheBackend) {
+	var cache = newCache(t, 0, 2)
+
+	storeString(t, cache, "a", "llamas")
+	storeString(t, cache, "b", "alpacas")
+
+	resA, err := cache.Retrieve("a")
+	require.NoError(t, err)
+	resA.Close()
+
+	storeString(t, cache, "c", "vicuñas")
+
+	_, err = cache.Retrieve("b")
+	require.Equal(t, httpcache.ErrNotFoundInCache, err)
+
+	resA, err = cache.Retrieve("a")
+	require.NoError(t, err)
+	require.Equal(t, "llamas", readAllString(resA))
+
+	resC, err := cache.Retrieve("c")
+	require.NoError(t, err)
+	require.Equal(t, "vicuñas", readAllString(resC))
+}
+
+func TestLimitedCacheEvictsWhenOverByteLimit(t *testing.T) {
+	eachBackend(t, testLimitedCacheEvictsWhenOverByteLimit)
+}
+
+func testLimitedCacheEvictsWhenOverByteLimit(t *testing.T, newCache cacheBackend) {
+	var body = strings.Repeat("llamas", 1000)
+	var cache = newCache(t, int64(len(body))*2, 0)
+
+	storeString(t, cache, "a", body)
+	storeString(t, cache, "b", body)
+
+	_, err := cache.Retrieve("a")
+	require.Equal(t, httpcache.ErrNotFoundInCache, err)
+
+	resB, err := cache.Retrieve("b")
+	require.NoError(t, err)
+	require.Equal(t, body, readAllString(resB))
+}
+
+func TestLimitedDiskCacheCountsExistingResources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cache, err := httpcache.NewDiskCache(dir)
+	require.NoError(t, err)
+	storeString(t, cache, "a", "llamas")
+	storeString(t, cache, "b", "alpacas")
+
+	cache, err = httpcache.NewLimitedDiskCache(dir, 0, 1)
+	require.NoError(t, err)
+
+	var found int
+	for _, key := range []string{"a", "b"} {
+		if res, err := cache.Retrieve(key); err == nil {
+			res.Close()
+			found++
+		}
+	}
+	require.Equal(t, 1, found)
+}
+
+func TestDiskCacheIgnoresBodyWithWrongLength(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cache, err := httpcache.NewDiskCache(dir)
+	require.NoError(t, err)
+	storeString(t, cache, "a", "llamas")
+
+	body := filepath.Join(dir, "body", "v1", fmt.Sprintf("%x", sha256.Sum256([]byte("a"))))
+	require.NoError(t, ioutil.WriteFile(body, []byte("llam"), 0600))
+
+	_, err = cache.Retrieve("a")
+	require.Equal(t, httpcache.ErrNotFoundInCache, err)
+}
+
+func TestDiskCacheRemovesTemporaryFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "tmp", "interrupted")
+	require.NoError(t, os.MkdirAll(filepath.Dir(tmp), 0700))
+	require.NoError(t, ioutil.WriteFile(tmp, []byte("llam"), 0600))
+
+	_, err = httpcache.NewDiskCache(dir)
+	require.NoError(t, err)
+
+	_, err = os.Stat(tmp)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestInvalidatePersistsAcrossRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	reopen := map[string]func() (httpcache.Cache, error){
+		"disk": func() (httpcache.Cache, error) {
+			return httpcache.NewDiskCache(filepath.Join(dir, "disk"))
+		},
+		"bolt": func() (httpcache.Cache, error) {
+			return boltcache.New(filepath.Join(dir, "cache.db"))
+		},
+	}
+
+	for name, open := range reopen {
+		t.Run(name, func(t *testing.T) {
+			cache, err := open()
+			require.NoError(t, err)
+
+			res := httpcache.NewResourceBytes(http.StatusOK, []byte("llamas"), http.Header{
+				"Date": []string{httpcache.Clock().Add(-time.Minute).Format(http.TimeFormat)},
+			})
+			require.NoError(t, cache.Store(res, "a"))
+			cache.Invalidate("a")
+
+			if c, ok := cache.(io.Closer); ok {
+				require.NoError(t, c.Close())
+			}
+
+			cache, err = open()
+			require.NoError(t, err)
+			if c, ok := cache.(io.Closer); ok {
+				defer c.Close()
+			}
+
+			res, err = cache.Retrieve("a")
+			require.NoError(t, err)
+			require.True(t, res.IsStale())
+			require.Equal(t, "llamas", readAllString(res))
+
+			storeString(t, cache, "a", "alpacas")
+			res, err = cache.Retrieve("a")
+			require.NoError(t, err)
+			require.False(t, res.IsStale())
+		})
+	}
+}
+
+func TestRecordFieldsCantBeSetByResponse(t *testing.T) {
+	eachBackend(t, testRecordFieldsCantBeSetByResponse)
+}
+
+func testRecordFieldsCantBeSetByResponse(t *testing.T, newCache cacheBackend) {
+	cache := newCache(t, 0, 0)
+
+	res := httpcache.NewResourceBytes(http.StatusOK, []byte("llamas"), http.Header{
+		"Date":                    []string{httpcache.Clock().Add(-time.Minute).Format(http.TimeFormat)},
+		"X-Httpcache-Stale":       []string{httpcache.Clock().Add(time.Hour).Format(time.RFC3339Nano)},
+		"X-Httpcache-Body-Length": []string{"3"},
+	})
+	require.NoError(t, cache.Store(res, "a"))
+
+	res, err := cache.Retrieve("a")
+	require.NoError(t, err)
+	assert.False(t, res.IsStale())
+	assert.Equal(t, "llamas", readAllString(res))
+	assert.Empty(t, res.Header().Get("X-Httpcache-Stale"))
+	assert.Empty(t, res.Header().Get("X-Httpcache-Body-Length"))
+}
+
+func TestResourceWriterCommitsOnClose(t *testing.T) {
+	eachBackend(t, testResourceWriterCommitsOnClose)
+}
+
+func testResourceWriterCommitsOnClose(t *testing.T, newCache cacheBackend) {
+	var cache = newCache(t, 0, 0)
+
+	w, err := cache.Writer(http.StatusOK, http.Header{"Llamas": []string{"true"}}, "a", "b")
+	require.NoError(t, err)
+
+	_, err = io.WriteString(w, "llamas")
+	require.NoError(t, err)
+
+	_, err = cache.Retrieve("a")
+	require.Equal(t, httpcache.ErrNotFoundInCache, err)
+
+	require.NoError(t, w.Close())
+
+	for _, key := range []string{"a", "b"} {
+		res, err := cache.Retrieve(key)
+		require.NoError(t, err)
+		require.Equal(t, "true", res.Header().Get("Llamas"))
+		require.Equal(t, "llamas", readAllString(res))
+	}
+}
+
+func TestResourceWriterAbort(t *testing.T) {
+	eachBackend(t, testResourceWriterAbort)
+}
+
+func testResourceWriterAbort(t *testing.T, newCache cacheBackend) {
+	var cache = newCache(t, 0, 0)
+	storeString(t, cache, "a", "llamas")
+
+	w, err := cache.Writer(http.StatusOK, http.Header{}, "a")
+	require.NoError(t, err)
+
+	_, err = io.WriteString(w, "alpacas")
+	require.NoError(t, err)
+	require.NoError(t, w.Abort())
+
+	res, err := cache.Retrieve("a")
+	require.NoError(t, err)
+	require.Equal(t, "llamas", readAllString(res))
+}
+
+func TestBoltCacheStreamsLargeBodies(t *testing.T) {
+	var body = strings.Repeat("llamas", 500000)
+	var cache = cacheBackends["bolt"](t, 0, 0)
+
+	storeString(t, cache, "a", body)
+
+	res, err := cache.Retrieve("a")
+	require.NoError(t, err)
+	require.Equal(t, body, readAllString(res))
+
+	_, err = res.Seek(int64(len(body)-12), io.SeekStart)
+	require.NoError(t, err)
+	require.Equal(t, "llamasllamas", readAllString(res))
+}
+
+func TestBoltCacheKeepsBodiesWhileRead(t *testing.T) {
+	var body = strings.Repeat("llamas", 500000)
+	var cache = cacheBackends["bolt"](t, 0, 1)
+
+	storeString(t, cache, "a", body)
+
+	res, err := cache.Retrieve("a")
+	require.NoError(t, err)
+	buf := make([]byte, 6)
+	_, err = io.ReadFull(res, buf)
+	require.NoError(t, err)
+
+	storeString(t, cache, "a", "alpacas")
+	storeString(t, cache, "b", "alpacas")
+
+	require.Equal(t, body[6:], readAllString(res))
+	require.NoError(t, res.Close())
+
+	res, err = cache.Retrieve("b")
+	require.NoError(t, err)
+	require.Equal(t, "alpacas", readAllString(res))
+}
+
+func TestLimitedBoltCacheCountsExistingResources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cache.db")
+
+	cache, err := boltcache.New(path)
+	require.NoError(t, err)
+	storeString(t, cache, "a", "llamas")
+	storeString(t, cache, "b", "alpacas")
+	require.NoError(t, cache.(io.Closer).Close())
+
+	cache, err = boltcache.NewLimited(path, 0, 1)
+	require.NoError(t, err)
+	defer cache.(io.Closer).Close()
+
+	var found int
+	for _, key := range []string{"a", "b"} {
+		if res, err := cache.Retrieve(key); err == nil {
+			res.Close()
+			found++
+		}
+	}
+	require.Equal(t, 1, found)
+}
+
+// TestConcurrentCacheAccess is intended to be run with -race, it checks that
+// readers never see the header of one write with the body of another
+func TestConcurrentCacheAccess(t *testing.T) {
+	eachBackend(t, testConcurrentCacheAccess)
+}
+
+func testConcurrentCacheAccess(t *testing.T, newCache cacheBackend) {
+	var cache = newCache(t, 0, 3)
+	var keys = []string{"a", "b", "c", "d"}
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 50; j++ {
+				key := keys[(i+j)%len(keys)]
+				value := strconv.Itoa(i*1000 + j)
+
+				switch j % 4 {
+				case 0:
+					res := httpcache.NewResourceBytes(http.StatusOK,
+						[]byte(strings.Repeat(value, j+1)), http.Header{"Llamas": []string{value}})
+					assert.NoError(t, cache.Store(res, key, key+"-alias"))
+				case 1:
+					cache.Invalidate(key)
+				case 2:
+					if _, err := cache.Header(key); err != httpcache.ErrNotFoundInCache {
+						assert.NoError(t, err)
+					}
+				default:
+					res, err := cache.Retrieve(key)
+					if err == httpcache.ErrNotFoundInCache {
+						continue
+					}
+					if assert.NoError(t, err) {
+						value := res.Header().Get("Llamas")
+						body := readAllString(res)
+						assert.Equal(t, strings.Repeat(value, len(body)/len(value)), body)
+					}
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+// TestConcurrentEvictionKeepsAccounting checks that an entry stored again while
+// it's being evicted is either tracked and stored, or neither
+func TestConcurrentEvictionKeepsAccounting(t *testing.T) {
+	eachBackend(t, testConcurrentEvictionKeepsAccounting)
+}
+
+func testConcurrentEvictionKeepsAccounting(t *testing.T, newCache cacheBackend) {
+	var cache = newCache(t, 0, 2)
+	var keys = []string{"a", "b", "c"}
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				storeString(t, cache, keys[(i+j)%len(keys)], "llamas")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var stored int64
+	for _, key := range keys {
+		if res, err := cache.Retrieve(key); err == nil {
+			res.Close()
+			stored++
+		}
+	}
+	assert.Equal(t, stored, cache.(httpcache.StatsCache).Stats().Entries)
+}
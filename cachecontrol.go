@@ -19,45 +19,155 @@ func ParseCacheControlHeaders(h http.Header) (CacheControl, error) {
 	return ParseCacheControl(strings.Join(h["Cache-Control"], ", "))
 }
 
+// ParseCacheControl parses the directives of a Cache-Control header as per the
+// grammar of RFC 7234 §5.2, returning an error if it's malformed. Directive names
+// are case-insensitive and are lowercased, values are unquoted.
 func ParseCacheControl(input string) (CacheControl, error) {
+	return parseCacheControl(input, true)
+}
+
+// parseCacheControlLenient parses a Cache-Control header like ParseCacheControl,
+// but recovers from malformed directives rather than rejecting the header.
+// Whitespace is allowed around "=", an unterminated quoted-string runs to the end
+// of the header, and anything else after a directive is skipped up to the next
+// comma. It's what the Handler uses for the headers it's sent.
+func parseCacheControlLenient(input string) CacheControl {
+	cc, _ := parseCacheControl(input, false)
+	return cc
+}
+
+func parseCacheControl(input string, strict bool) (CacheControl, error) {
 	cc := make(CacheControl)
-	length := len(input)
-	isValue := false
-	lastKey := ""
-
-	for pos := 0; pos < length; pos++ {
-		var token string
-		switch input[pos] {
-		case '"':
-			if offset := strings.IndexAny(input[pos+1:], `"`); offset != -1 {
-				token = input[pos+1 : pos+1+offset]
-			} else {
-				token = input[pos+1:]
+	rest := input
+
+	// skip drops the rest of a malformed directive, unless parsing strictly
+	skip := func(err error) error {
+		if strict {
+			return err
+		}
+		if i := strings.IndexByte(rest, ','); i >= 0 {
+			rest = rest[i:]
+		} else {
+			rest = ""
+		}
+		return nil
+	}
+
+	for {
+		// empty list elements are allowed, as per RFC 7230 §7
+		rest = strings.TrimLeft(rest, " \t,")
+		if rest == "" {
+			return cc, nil
+		}
+
+		n := tokenLength(rest)
+		if n == 0 {
+			if err := skip(fmt.Errorf("malformed directive in Cache-Control %q", input)); err != nil {
+				return nil, err
 			}
-			pos += len(token) + 1
-		case ',', '\n', '\r', ' ', '\t':
 			continue
-		case '=':
-			isValue = true
-			continue
-		default:
-			if offset := strings.IndexAny(input[pos:], "\"\n\t\r ,="); offset != -1 {
-				token = input[pos : pos+offset]
-			} else {
-				token = input[pos:]
+		}
+		key := strings.ToLower(rest[:n])
+		rest = rest[n:]
+		if !strict {
+			rest = strings.TrimLeft(rest, " \t")
+		}
+
+		var val string
+		if strings.HasPrefix(rest, "=") {
+			rest = rest[1:]
+			if !strict {
+				rest = strings.TrimLeft(rest, " \t")
+			}
+
+			if strings.HasPrefix(rest, `"`) {
+				unquoted, after, ok := unquoteString(rest)
+				if ok {
+					val, rest = unquoted, after
+				} else if strict {
+					return nil, fmt.Errorf("malformed quoted-string in Cache-Control %q", input)
+				} else {
+					val, rest = strings.TrimSpace(rest[1:]), ""
+				}
+			} else if n = tokenLength(rest); n > 0 {
+				val, rest = rest[:n], rest[n:]
+			} else if strict {
+				return nil, fmt.Errorf("missing value for %s in Cache-Control %q", key, input)
 			}
-			pos += len(token) - 1
 		}
-		if isValue {
-			cc.Add(lastKey, token)
-			isValue = false
-		} else {
-			cc.Add(token, "")
-			lastKey = token
+
+		rest = strings.TrimLeft(rest, " \t")
+		if rest != "" && rest[0] != ',' {
+			if err := skip(fmt.Errorf("malformed directive %s in Cache-Control %q", key, input)); err != nil {
+				return nil, err
+			}
+		}
+
+		cc.Add(key, val)
+	}
+}
+
+// tokenLength returns the length of the token at the start of s, as per RFC 7230 §3.2.6
+func tokenLength(s string) int {
+	for i := 0; i < len(s); i++ {
+		if !isTokenChar(s[i]) {
+			return i
+		}
+	}
+	return len(s)
+}
+
+func isTokenChar(c byte) bool {
+	return c > 0x20 && c < 0x7f && strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) == -1
+}
+
+// unquoteString unquotes the quoted-string at the start of s as per RFC 7230
+// §3.2.6, returning the rest of s after it or false if it's malformed
+func unquoteString(s string) (string, string, bool) {
+	b := &bytes.Buffer{}
+
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"':
+			return b.String(), s[i+1:], true
+		case c == '\\':
+			if i+1 == len(s) || !isQuotedChar(s[i+1]) {
+				return "", "", false
+			}
+			i++
+			b.WriteByte(s[i])
+		case isQuotedChar(c):
+			b.WriteByte(c)
+		default:
+			return "", "", false
 		}
 	}
 
-	return cc, nil
+	return "", "", false
+}
+
+// isQuotedChar returns whether a character can be in a quoted-string, escaped
+// or not
+func isQuotedChar(c byte) bool {
+	return c == '\t' || c >= 0x20 && c != 0x7f
+}
+
+// quoteString returns s as a token if it is one, or as a quoted-string
+func quoteString(s string) string {
+	if s != "" && tokenLength(s) == len(s) {
+		return s
+	}
+
+	b := &bytes.Buffer{}
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' || s[i] == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	b.WriteByte('"')
+	return b.String()
 }
 
 func (cc CacheControl) Get(key string) (string, bool) {
@@ -82,28 +192,138 @@ func (cc CacheControl) Has(key string) bool {
 	return exists
 }
 
+// maxDeltaSeconds is the largest delta-seconds value, larger values are treated
+// as it as per RFC 7234 §1.2.1
+const maxDeltaSeconds = 1 << 31
+
+// Duration parses the delta-seconds value of a directive as per RFC 7234 §1.2.1,
+// values that are too large saturate at 2^31 seconds
 func (cc CacheControl) Duration(key string) (time.Duration, error) {
 	d, _ := cc.Get(key)
-	return time.ParseDuration(d + "s")
+	if d == "" {
+		return time.Duration(0), fmt.Errorf("missing delta-seconds for %s", key)
+	}
+
+	var seconds int64
+	for i := 0; i < len(d); i++ {
+		if d[i] < '0' || d[i] > '9' {
+			return time.Duration(0), fmt.Errorf("invalid delta-seconds %q for %s", d, key)
+		}
+		if seconds < maxDeltaSeconds {
+			seconds = seconds*10 + int64(d[i]-'0')
+		}
+	}
+
+	if seconds > maxDeltaSeconds {
+		seconds = maxDeltaSeconds
+	}
+	return time.Duration(seconds) * time.Second, nil
 }
 
+// String returns the directives in the form of a Cache-Control header, sorted by
+// name, with values quoted where needed
 func (cc CacheControl) String() string {
-	keys := make([]string, len(cc))
-	for k, _ := range cc {
+	keys := make([]string, 0, len(cc))
+	for k := range cc {
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
-	buf := bytes.Buffer{}
 
+	var directives []string
 	for _, k := range keys {
 		vals := cc[k]
 		if len(vals) == 0 {
-			buf.WriteString(k + ", ")
+			directives = append(directives, k)
 		}
 		for _, val := range vals {
-			buf.WriteString(fmt.Sprintf("%s=%q, ", k, val))
+			directives = append(directives, k+"="+quoteString(val))
 		}
 	}
 
-	return strings.TrimSuffix(buf.String(), ", ")
+	return strings.Join(directives, ", ")
+}
+
+// Directives are the well-known directives of a Cache-Control header, as per
+// RFC 7234 §5.2 and RFC 5861. Durations are nil if their directive isn't present.
+type Directives struct {
+	MaxAge   *time.Duration
+	SMaxAge  *time.Duration
+	MinFresh *time.Duration
+	// MaxStale is 2^31 seconds if max-stale is present without a value
+	MaxStale             *time.Duration
+	StaleWhileRevalidate *time.Duration
+	StaleIfError         *time.Duration
+	NoCache              bool
+	NoStore              bool
+	NoTransform          bool
+	OnlyIfCached         bool
+	MustRevalidate       bool
+	ProxyRevalidate      bool
+	Public               bool
+	Private              bool
+	// NoCacheHeaders and PrivateHeaders are the field names that no-cache and
+	// private directives are limited to, if any
+	NoCacheHeaders []string
+	PrivateHeaders []string
+	// Extensions are the directives that aren't well-known
+	Extensions CacheControl
+}
+
+// Directives returns the well-known directives, or an error if a value is invalid
+func (cc CacheControl) Directives() (Directives, error) {
+	d := Directives{Extensions: CacheControl{}}
+
+	durations := map[string]**time.Duration{
+		"max-age":                &d.MaxAge,
+		"s-maxage":               &d.SMaxAge,
+		"min-fresh":              &d.MinFresh,
+		"max-stale":              &d.MaxStale,
+		"stale-while-revalidate": &d.StaleWhileRevalidate,
+		"stale-if-error":         &d.StaleIfError,
+	}
+	flags := map[string]*bool{
+		"no-cache":         &d.NoCache,
+		"no-store":         &d.NoStore,
+		"no-transform":     &d.NoTransform,
+		"only-if-cached":   &d.OnlyIfCached,
+		"must-revalidate":  &d.MustRevalidate,
+		"proxy-revalidate": &d.ProxyRevalidate,
+		"public":           &d.Public,
+		"private":          &d.Private,
+	}
+
+	for key, vals := range cc {
+		if field, ok := durations[key]; ok {
+			duration := time.Duration(maxDeltaSeconds) * time.Second
+			if key != "max-stale" || len(vals) > 0 {
+				var err error
+				if duration, err = cc.Duration(key); err != nil {
+					return Directives{}, err
+				}
+			}
+			*field = &duration
+		} else if field, ok := flags[key]; ok {
+			*field = true
+		} else {
+			d.Extensions[key] = vals
+		}
+	}
+
+	d.NoCacheHeaders = fieldNames(cc["no-cache"])
+	d.PrivateHeaders = fieldNames(cc["private"])
+	return d, nil
+}
+
+// fieldNames returns the canonical header names in the values of a directive
+// that takes a list of them, such as private and no-cache
+func fieldNames(vals []string) []string {
+	var names []string
+	for _, val := range vals {
+		for _, name := range strings.Split(val, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
 }
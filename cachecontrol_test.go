@@ -2,6 +2,7 @@ package httpcache_test
 
 import (
 	"testing"
+	"time"
 
 	. "github.com/lox/httpcache"
 	"github.com/stretchr/testify/require"
@@ -30,9 +31,14 @@ func TestParsingCacheControl(t *testing.T) {
 		{`max-stale=60`, CacheControl{
 			"max-stale": []string{"60"},
 		}},
-		{`" max-age=8,max-age=8 "=blah`, CacheControl{
-			" max-age=8,max-age=8 ": []string{"blah"},
+		{`no-cache="Set-Cookie, \"X-Llamas\"", Max-Age=60,,`, CacheControl{
+			"no-cache": []string{`Set-Cookie, "X-Llamas"`},
+			"max-age":  []string{"60"},
 		}},
+		{`private=a, private=b`, CacheControl{
+			"private": []string{"a", "b"},
+		}},
+		{``, CacheControl{}},
 	}
 
 	for _, expect := range table {
@@ -42,10 +48,83 @@ func TestParsingCacheControl(t *testing.T) {
 		}
 
 		require.Equal(t, cc, expect.ccStruct)
-		require.NotEmpty(t, cc.String())
+
+		reparsed, err := ParseCacheControl(cc.String())
+		require.NoError(t, err)
+		require.Equal(t, cc, reparsed)
+	}
+}
+
+func TestParsingMalformedCacheControl(t *testing.T) {
+	for _, s := range []string{
+		`" max-age=8,max-age=8 "=blah`,
+		`max-age=`,
+		`max-age = 60`,
+		`max-age=60 public`,
+		`private="unterminated`,
+		`private="a"b`,
+		`no-cache, (public)`,
+		`max-age=1;2`,
+	} {
+		_, err := ParseCacheControl(s)
+		require.Error(t, err, s)
 	}
 }
 
+func TestCacheControlDuration(t *testing.T) {
+	cc, err := ParseCacheControl(`max-age=60, s-maxage="30", max-stale=99999999999, min-fresh=1.5, stale-if-error=-5, no-cache`)
+	require.NoError(t, err)
+
+	d, err := cc.Duration("max-age")
+	require.NoError(t, err)
+	require.Equal(t, time.Minute, d)
+
+	d, err = cc.Duration("s-maxage")
+	require.NoError(t, err)
+	require.Equal(t, 30*time.Second, d)
+
+	d, err = cc.Duration("max-stale")
+	require.NoError(t, err)
+	require.Equal(t, time.Duration(1<<31)*time.Second, d)
+
+	for _, key := range []string{"min-fresh", "stale-if-error", "no-cache", "missing"} {
+		_, err = cc.Duration(key)
+		require.Error(t, err, key)
+	}
+}
+
+func TestCacheControlString(t *testing.T) {
+	cc := CacheControl{
+		"public":    []string{},
+		"private":   []string{"Set-Cookie, X-Llamas"},
+		"max-age":   []string{"60"},
+		"extension": []string{`a "quoted" \ value`},
+	}
+	require.Equal(t, `extension="a \"quoted\" \\ value", max-age=60, private="Set-Cookie, X-Llamas", public`, cc.String())
+}
+
+func TestCacheControlDirectives(t *testing.T) {
+	cc, err := ParseCacheControl(`public, max-age=60, max-stale, private="set-cookie, x-llamas", no-store, llamas=fully`)
+	require.NoError(t, err)
+
+	d, err := cc.Directives()
+	require.NoError(t, err)
+	require.True(t, d.Public)
+	require.True(t, d.Private)
+	require.True(t, d.NoStore)
+	require.False(t, d.NoCache)
+	require.Equal(t, time.Minute, *d.MaxAge)
+	require.Equal(t, time.Duration(1<<31)*time.Second, *d.MaxStale)
+	require.Nil(t, d.SMaxAge)
+	require.Equal(t, []string{"Set-Cookie", "X-Llamas"}, d.PrivateHeaders)
+	require.Equal(t, CacheControl{"llamas": []string{"fully"}}, d.Extensions)
+
+	cc, err = ParseCacheControl(`max-age=1.5`)
+	require.NoError(t, err)
+	_, err = cc.Directives()
+	require.Error(t, err)
+}
+
 func BenchmarkCacheControlParsing(b *testing.B) {
 	b.ReportAllocs()
 	b.ResetTimer()
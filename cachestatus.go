@@ -0,0 +1,104 @@
+package httpcache
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Reasons that a request was forwarded upstream, as per RFC 9211 §2.2
+const (
+	fwdURIMiss  = "uri-miss"
+	fwdVaryMiss = "vary-miss"
+	fwdStale    = "stale"
+	fwdRequest  = "request"
+	fwdBypass   = "bypass"
+)
+
+// cacheStatus records how the cache handled a request, for the Cache-Status
+// header of RFC 9211
+type cacheStatus struct {
+	fwd       string
+	fwdStatus int
+	stored    bool
+	collapsed bool
+	ttl       *time.Duration
+}
+
+// forwarded records that the request was forwarded upstream for a reason,
+// keeping the first reason if it was forwarded more than once
+func (s *cacheStatus) forwarded(reason string) {
+	if s.fwd == "" {
+		s.fwd = reason
+	}
+}
+
+// format returns the Cache-Status list member for a cache with the given name,
+// hit is whether the response came from the cache
+func (s *cacheStatus) format(name string, hit bool, key string) string {
+	params := []string{name}
+
+	if hit && s.fwd == "" {
+		params = append(params, "hit")
+	}
+	if s.fwd != "" {
+		params = append(params, "fwd="+s.fwd)
+	}
+	if s.fwdStatus != 0 {
+		params = append(params, fmt.Sprintf("fwd-status=%d", s.fwdStatus))
+	}
+	if s.ttl != nil {
+		params = append(params, fmt.Sprintf("ttl=%d", int64(s.ttl.Seconds())))
+	}
+	if s.stored {
+		params = append(params, "stored")
+	}
+	if s.collapsed {
+		params = append(params, "collapsed")
+	}
+	if key != "" {
+		params = append(params, fmt.Sprintf("key=%q", key))
+	}
+
+	return strings.Join(params, "; ")
+}
+
+// cacheStatusWriter adds the Cache-Status header to a response when it's written,
+// after any Cache-Status members from upstream
+type cacheStatusWriter struct {
+	http.ResponseWriter
+	name        string
+	key         string
+	status      *cacheStatus
+	wroteHeader bool
+}
+
+func (w *cacheStatusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+
+		h := w.Header()
+		cacheHeader := h.Get(CacheHeader)
+		member := w.status.format(w.name, cacheHeader == "HIT" || cacheHeader == "STALE", w.key)
+
+		if existing := h["Cache-Status"]; len(existing) > 0 {
+			member = strings.Join(existing, ", ") + ", " + member
+		}
+		h.Set("Cache-Status", member)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cacheStatusWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *cacheStatusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
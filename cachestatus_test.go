@@ -0,0 +1,87 @@
+package httpcache_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lox/httpcache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheStatusHeader(t *testing.T) {
+	client, upstream := testSetup()
+	client.cacheHandler.CacheStatus = "httpcache"
+	upstream.CacheControl = "max-age=60"
+	upstream.Etag = `"llamas"`
+
+	r1 := client.get("/")
+	assert.Equal(t, "httpcache; fwd=uri-miss; fwd-status=200; stored", r1.header.Get("Cache-Status"))
+
+	upstream.timeTravel(time.Second * 30)
+	r2 := client.get("/")
+	assert.Equal(t, "httpcache; hit; ttl=30", r2.header.Get("Cache-Status"))
+
+	upstream.timeTravel(time.Second * 60)
+	r3 := client.get("/")
+	assert.Equal(t, "httpcache; fwd=stale; fwd-status=304; ttl=60; stored", r3.header.Get("Cache-Status"))
+
+	r4 := client.get("/", cc("no-cache"))
+	assert.Equal(t, "httpcache; fwd=request; fwd-status=200", r4.header.Get("Cache-Status"))
+
+	r5 := client.post("/")
+	assert.Equal(t, "httpcache; fwd=bypass; fwd-status=200", r5.header.Get("Cache-Status"))
+}
+
+func TestCacheStatusHeaderIsOptional(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+
+	assert.Equal(t, "", client.get("/").header.Get("Cache-Status"))
+	assert.Equal(t, "", client.get("/").header.Get("Cache-Status"))
+}
+
+func TestCacheStatusHeaderForVaryMiss(t *testing.T) {
+	client, upstream := testSetup()
+	client.cacheHandler.CacheStatus = "httpcache"
+	upstream.CacheControl = "max-age=60"
+	upstream.Vary = "Accept-Language"
+
+	r1 := client.get("/", "Accept-Language: en")
+	assert.Equal(t, "httpcache; fwd=uri-miss; fwd-status=200; stored", r1.header.Get("Cache-Status"))
+
+	r2 := client.get("/", "Accept-Language: de")
+	assert.Equal(t, "httpcache; fwd=vary-miss; fwd-status=200; stored", r2.header.Get("Cache-Status"))
+}
+
+func TestCacheStatusHeaderAppendsToUpstream(t *testing.T) {
+	client, upstream := testSetup()
+	client.cacheHandler.CacheStatus = "httpcache"
+	upstream.CacheControl = "max-age=60"
+	upstream.Header.Set("Cache-Status", "origin; fwd=uri-miss")
+	upstream.Header.Add("Cache-Status", "cdn; hit")
+
+	r1 := client.get("/")
+	assert.Equal(t, []string{"origin; fwd=uri-miss, cdn; hit, httpcache; fwd=uri-miss; fwd-status=200; stored"},
+		r1.header["Cache-Status"])
+
+	r2 := client.get("/")
+	assert.Equal(t, []string{"origin; fwd=uri-miss, cdn; hit, httpcache; hit; ttl=60"},
+		r2.header["Cache-Status"])
+}
+
+func TestCacheStatusHeaderForCollapsedRequests(t *testing.T) {
+	upstream := &slowUpstream{CacheControl: "max-age=60", Delay: time.Millisecond * 50}
+	handler := httpcache.NewHandler(httpcache.NewMemoryCache(), upstream)
+	handler.CacheStatus = "httpcache"
+
+	var collapsed int
+	for _, rec := range concurrentGets(handler, 5) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		if strings.HasSuffix(rec.HeaderMap.Get("Cache-Status"), "; collapsed") {
+			collapsed++
+		}
+	}
+	assert.Equal(t, 4, collapsed)
+}
@@ -0,0 +1,12 @@
+//go:build !plan9 && !wasm
+
+package main
+
+import (
+	"github.com/lox/httpcache"
+	"github.com/lox/httpcache/boltcache"
+)
+
+func newBoltCache(path string, maxBytes int64, maxEntries int) (httpcache.Cache, error) {
+	return boltcache.NewLimited(path, maxBytes, maxEntries)
+}
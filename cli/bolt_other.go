@@ -0,0 +1,14 @@
+//go:build plan9 || wasm
+
+package main
+
+import (
+	"errors"
+
+	"github.com/lox/httpcache"
+)
+
+// newBoltCache fails, as bolt doesn't support this platform
+func newBoltCache(path string, maxBytes int64, maxEntries int) (httpcache.Cache, error) {
+	return nil, errors.New("bolt isn't supported on this platform")
+}
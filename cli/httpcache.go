@@ -23,14 +23,26 @@ var (
 	dir      string
 	dumpHttp bool
 	verbose  bool
+	maxSize  int64
+	maxItems int
+	offline  bool
+	boltPath string
+	admin    string
+	status   string
 )
 
 func init() {
 	flag.StringVar(&listen, "listen", defaultListen, "the host and port to bind to")
 	flag.StringVar(&dir, "dir", defaultDir, "the dir to store cache data in, implies -disk")
 	flag.BoolVar(&useDisk, "disk", false, "whether to store cache data to disk")
+	flag.StringVar(&boltPath, "bolt", "", "the bolt database file to store cache data in")
+	flag.Int64Var(&maxSize, "maxsize", 0, "the maximum bytes of cache data to keep, 0 for no limit")
+	flag.IntVar(&maxItems, "maxitems", 0, "the maximum number of cached resources to keep, 0 for no limit")
 	flag.BoolVar(&verbose, "v", false, "show verbose output and debugging")
 	flag.BoolVar(&private, "private", false, "make the cache private")
+	flag.BoolVar(&offline, "offline", false, "serve everything from the cache, SIGUSR1 toggles on unix")
+	flag.StringVar(&admin, "admin", "", "the host and port to serve /metrics on, disabled if empty")
+	flag.StringVar(&status, "cachestatus", "", "the cache name to add a Cache-Status header with, disabled if empty")
 	flag.BoolVar(&dumpHttp, "dumphttp", false, "dumps http requests and responses to stdout")
 	flag.Parse()
 
@@ -49,22 +61,43 @@ func main() {
 
 	var cache httpcache.Cache
 
-	if useDisk && dir != "" {
+	if boltPath != "" {
+		log.Printf("storing cached resources in %s", boltPath)
+		var err error
+		cache, err = newBoltCache(boltPath, maxSize, maxItems)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if useDisk && dir != "" {
 		log.Printf("storing cached resources in %s", dir)
 		if err := os.MkdirAll(dir, 0700); err != nil {
 			log.Fatal(err)
 		}
 		var err error
-		cache, err = httpcache.NewDiskCache(dir)
+		cache, err = httpcache.NewLimitedDiskCache(dir, maxSize, maxItems)
 		if err != nil {
 			log.Fatal(err)
 		}
 	} else {
-		cache = httpcache.NewMemoryCache()
+		cache = httpcache.NewLimitedMemoryCache(maxSize, maxItems)
 	}
 
 	handler := httpcache.NewHandler(cache, proxy)
 	handler.Shared = !private
+	handler.CacheStatus = status
+	handler.SetOffline(offline)
+
+	toggleOfflineOnSignal(handler)
+
+	if admin != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", handler.MetricsHandler())
+
+		log.Printf("serving metrics on http://%s/metrics", admin)
+		go func() {
+			log.Fatal(http.ListenAndServe(admin, mux))
+		}()
+	}
 
 	respLogger := httplog.NewResponseLogger(handler)
 	respLogger.DumpRequests = dumpHttp
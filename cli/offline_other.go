@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "github.com/lox/httpcache"
+
+// toggleOfflineOnSignal does nothing, as there's no SIGUSR1 outside of unix
+func toggleOfflineOnSignal(handler *httpcache.Handler) {}
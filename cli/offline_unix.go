@@ -0,0 +1,24 @@
+//go:build unix
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/lox/httpcache"
+)
+
+// toggleOfflineOnSignal toggles whether the handler is offline on SIGUSR1
+func toggleOfflineOnSignal(handler *httpcache.Handler) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			handler.SetOffline(!handler.IsOffline())
+			log.Printf("offline mode is now %v", handler.IsOffline())
+		}
+	}()
+}
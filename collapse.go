@@ -0,0 +1,53 @@
+package httpcache
+
+import "sync"
+
+// flight is a request that has been passed upstream, which other requests
+// for the same key can wait on rather than making their own upstream request
+type flight struct {
+	key    string
+	done   chan struct{}
+	stored bool
+}
+
+// flightGroup tracks the in-flight upstream requests by key
+type flightGroup struct {
+	sync.Mutex
+	flights map[string]*flight
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: map[string]*flight{}}
+}
+
+// join returns the in-flight request for a key, creating it if there is none.
+// The bool returned is true if the caller created it and must finish it.
+func (g *flightGroup) join(key string) (*flight, bool) {
+	g.Lock()
+	defer g.Unlock()
+
+	if f, ok := g.flights[key]; ok {
+		return f, false
+	}
+
+	f := &flight{key: key, done: make(chan struct{})}
+	g.flights[key] = f
+	return f, true
+}
+
+// finish removes a flight and wakes up any requests waiting on it, stored
+// is whether the response was stored in the cache. A nil flight is ignored.
+func (g *flightGroup) finish(f *flight, stored bool) {
+	if f == nil {
+		return
+	}
+
+	g.Lock()
+	defer g.Unlock()
+
+	if g.flights[f.key] == f {
+		delete(g.flights, f.key)
+		f.stored = stored
+		close(f.done)
+	}
+}
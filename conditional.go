@@ -0,0 +1,87 @@
+package httpcache
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// conditionalHeaders are the request headers evaluated by checkPreconditions
+var conditionalHeaders = []string{
+	"If-Match",
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Unmodified-Since",
+}
+
+// checkPreconditions evaluates the conditional headers of a request against a
+// cached resource in the order given by RFC 7232 §6. It returns the status to
+// respond with in place of the resource, or 0 if the resource should be served.
+func checkPreconditions(r *http.Request, res *Resource) int {
+	etag := res.Header().Get("Etag")
+	lastModified := res.LastModified()
+
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if !etagListMatches(ifMatch, etag, true) {
+			return http.StatusPreconditionFailed
+		}
+	} else if t, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); err == nil {
+		if !lastModified.IsZero() && lastModified.Truncate(time.Second).After(t) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	safe := r.Method == "GET" || r.Method == "HEAD"
+
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if etagListMatches(ifNoneMatch, etag, false) {
+			if safe {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if t, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && safe {
+		if !lastModified.IsZero() && !lastModified.Truncate(time.Second).After(t) {
+			return http.StatusNotModified
+		}
+	}
+
+	return 0
+}
+
+// etagListMatches returns whether an If-Match or If-None-Match header matches an
+// entity tag, using strong or weak comparison as per RFC 7232 §2.3.2
+func etagListMatches(list, etag string, strong bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+
+	t, err := ParseEntityTag(etag)
+	if err != nil {
+		return false
+	}
+
+	tags, err := ParseEntityTags(list)
+	if err != nil {
+		debugf("ignoring malformed entity-tags: %v", err)
+		return false
+	}
+
+	if strong {
+		return tags.StrongMatch(t)
+	}
+	return tags.WeakMatch(t)
+}
+
+// writePrecondition responds with the status returned by checkPreconditions,
+// without the headers that describe the body of the resource
+func writePrecondition(w http.ResponseWriter, status int) {
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	if status == http.StatusNotModified && h.Get("Etag") != "" {
+		h.Del("Last-Modified")
+	}
+	w.WriteHeader(status)
+}
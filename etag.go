@@ -0,0 +1,114 @@
+package httpcache
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EntityTag is an entity-tag as per RFC 7232 §2.3, Tag is the opaque tag without
+// its quotes
+type EntityTag struct {
+	Tag  string
+	Weak bool
+}
+
+// ParseEntityTag parses a single entity-tag, such as the value of an ETag header
+func ParseEntityTag(s string) (EntityTag, error) {
+	tags, err := ParseEntityTags(s)
+	if err != nil {
+		return EntityTag{}, err
+	}
+	if len(tags) != 1 {
+		return EntityTag{}, fmt.Errorf("expected a single entity-tag in %q", s)
+	}
+	return tags[0], nil
+}
+
+func (t EntityTag) String() string {
+	if t.Weak {
+		return `W/"` + t.Tag + `"`
+	}
+	return `"` + t.Tag + `"`
+}
+
+// StrongMatch returns whether two entity-tags are equal and neither is weak
+func (t EntityTag) StrongMatch(o EntityTag) bool {
+	return !t.Weak && !o.Weak && t.Tag == o.Tag
+}
+
+// WeakMatch returns whether two entity-tags are equal, regardless of either being weak
+func (t EntityTag) WeakMatch(o EntityTag) bool {
+	return t.Tag == o.Tag
+}
+
+// EntityTags is a list of entity-tags, such as the value of an If-None-Match header
+type EntityTags []EntityTag
+
+// ParseEntityTags parses a comma separated list of entity-tags. The "*" that
+// If-Match and If-None-Match accept isn't a list and has to be handled by the caller.
+func ParseEntityTags(s string) (EntityTags, error) {
+	var tags EntityTags
+	rest := s
+
+	for {
+		// empty list elements are allowed, as per RFC 7230 §7
+		rest = strings.TrimLeft(rest, " \t,")
+		if rest == "" {
+			return tags, nil
+		}
+
+		var t EntityTag
+		if strings.HasPrefix(rest, "W/") {
+			t.Weak = true
+			rest = rest[2:]
+		}
+
+		if !strings.HasPrefix(rest, `"`) {
+			return nil, fmt.Errorf("malformed entity-tag in %q", s)
+		}
+		end := strings.IndexByte(rest[1:], '"')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated entity-tag in %q", s)
+		}
+		t.Tag = rest[1 : end+1]
+		for i := 0; i < len(t.Tag); i++ {
+			if c := t.Tag[i]; c <= ' ' || c == 0x7f {
+				return nil, fmt.Errorf("invalid character in entity-tag in %q", s)
+			}
+		}
+		tags = append(tags, t)
+
+		rest = strings.TrimLeft(rest[end+2:], " \t")
+		if rest != "" && rest[0] != ',' {
+			return nil, fmt.Errorf("malformed entity-tag list %q", s)
+		}
+	}
+}
+
+func (tags EntityTags) String() string {
+	s := make([]string, len(tags))
+	for i, t := range tags {
+		s[i] = t.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// StrongMatch returns whether any of the entity-tags strongly match t
+func (tags EntityTags) StrongMatch(t EntityTag) bool {
+	for _, tag := range tags {
+		if tag.StrongMatch(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// WeakMatch returns whether any of the entity-tags weakly match t
+func (tags EntityTags) WeakMatch(t EntityTag) bool {
+	for _, tag := range tags {
+		if tag.WeakMatch(t) {
+			return true
+		}
+	}
+	return false
+}
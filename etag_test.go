@@ -0,0 +1,71 @@
+package httpcache_test
+
+import (
+	"testing"
+
+	. "github.com/lox/httpcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsingEntityTags(t *testing.T) {
+	table := []struct {
+		s    string
+		tags EntityTags
+	}{
+		{`"xyzzy"`, EntityTags{{Tag: "xyzzy"}}},
+		{`W/"xyzzy"`, EntityTags{{Tag: "xyzzy", Weak: true}}},
+		{`""`, EntityTags{{Tag: ""}}},
+		{`"xyzzy", W/"r2d2xxxx" ,"c3piozzzz"`, EntityTags{
+			{Tag: "xyzzy"},
+			{Tag: "r2d2xxxx", Weak: true},
+			{Tag: "c3piozzzz"},
+		}},
+		{`"a,b", , "c"`, EntityTags{{Tag: "a,b"}, {Tag: "c"}}},
+	}
+
+	for _, expect := range table {
+		tags, err := ParseEntityTags(expect.s)
+		require.NoError(t, err, expect.s)
+		assert.Equal(t, expect.tags, tags, expect.s)
+	}
+}
+
+func TestParsingMalformedEntityTags(t *testing.T) {
+	for _, s := range []string{`xyzzy`, `"xyzzy`, `w/"xyzzy"`, `"xy zzy"`, `"a" "b"`, `*`} {
+		_, err := ParseEntityTags(s)
+		assert.Error(t, err, s)
+	}
+
+	_, err := ParseEntityTag(`"a", "b"`)
+	assert.Error(t, err)
+}
+
+func TestEntityTagComparison(t *testing.T) {
+	table := []struct {
+		a, b         string
+		strong, weak bool
+	}{
+		{`W/"1"`, `W/"1"`, false, true},
+		{`W/"1"`, `W/"2"`, false, false},
+		{`W/"1"`, `"1"`, false, true},
+		{`"1"`, `"1"`, true, true},
+	}
+
+	for _, expect := range table {
+		a, err := ParseEntityTag(expect.a)
+		require.NoError(t, err)
+		b, err := ParseEntityTag(expect.b)
+		require.NoError(t, err)
+
+		assert.Equal(t, expect.strong, a.StrongMatch(b), "%s strong %s", expect.a, expect.b)
+		assert.Equal(t, expect.weak, a.WeakMatch(b), "%s weak %s", expect.a, expect.b)
+		assert.Equal(t, expect.a, a.String())
+	}
+
+	tags := EntityTags{{Tag: "1", Weak: true}, {Tag: "2"}}
+	assert.Equal(t, `W/"1", "2"`, tags.String())
+	assert.True(t, tags.WeakMatch(EntityTag{Tag: "1"}))
+	assert.False(t, tags.StrongMatch(EntityTag{Tag: "1"}))
+	assert.True(t, tags.StrongMatch(EntityTag{Tag: "2"}))
+}
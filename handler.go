@@ -1,28 +1,33 @@
 package httpcache
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"math"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"gopkg.in/djherbis/stream.v1"
 )
 
 const (
 	CacheHeader     = "X-Cache"
 	ProxyDateHeader = "Proxy-Date"
+
+	defaultCollapseTimeout  = time.Second * 30
+	defaultOfflineStatus    = http.StatusGatewayTimeout
+	defaultRangeOffsetLimit = 1 << 20
 )
 
 var Writes sync.WaitGroup
 
+// storeable are the response statuses that are storeable by default
 var storeable = map[int]bool{
 	http.StatusOK:                   true,
 	http.StatusFound:                true,
@@ -31,6 +36,24 @@ var storeable = map[int]bool{
 	http.StatusMovedPermanently:     true,
 	http.StatusGone:                 true,
 	http.StatusNotFound:             true,
+	http.StatusPartialContent:       true,
+}
+
+// defaultStoreable returns a copy of the statuses that are storeable by default
+func defaultStoreable() map[int]bool {
+	statuses := map[int]bool{}
+	for status, ok := range storeable {
+		statuses[status] = ok
+	}
+	return statuses
+}
+
+// staleIfErrorStatuses are the upstream statuses that a stale resource can be served in place of
+var staleIfErrorStatuses = map[int]bool{
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
 }
 
 var cacheableByDefault = map[int]bool{
@@ -45,37 +68,121 @@ var cacheableByDefault = map[int]bool{
 }
 
 type Handler struct {
-	Shared    bool
-	upstream  http.Handler
-	validator *Validator
-	cache     Cache
+	Shared bool
+	// CollapseTimeout is how long a request that misses the cache will wait on
+	// an in-flight upstream request for the same key before making its own.
+	// Zero disables collapsed forwarding.
+	CollapseTimeout time.Duration
+	// StaleIfError is how long a resource can be stale and still be served in
+	// place of an upstream error, if neither the request nor the response have
+	// a stale-if-error directive
+	StaleIfError time.Duration
+	// Storeable is the set of response statuses that can be stored, it defaults
+	// to 200, 203, 206, 300, 301, 302, 404 and 410
+	Storeable map[int]bool
+	// NegativeTTL is how long 404 and 410 responses are fresh for if upstream
+	// doesn't give them an explicit freshness. Zero disables negative caching.
+	NegativeTTL time.Duration
+	// ErrorTTL is how long 5xx responses are fresh for if upstream doesn't give
+	// them an explicit freshness, which also makes them storeable. Zero disables
+	// caching of errors.
+	ErrorTTL time.Duration
+	// OfflineStatus is the status returned for requests that aren't in
+	// the cache while the handler is offline
+	OfflineStatus int
+	// CacheStatus is the name of the cache in the Cache-Status header of RFC 9211,
+	// which is only added to responses if it's set
+	CacheStatus string
+	// KeyFunc returns the Key that a request is cached under, it defaults to
+	// NewRequestKey. It's used for lookups, storage and invalidation alike, with
+	// QueryOptions applied to the Key it returns.
+	KeyFunc func(r *http.Request) Key
+	// Policy overrides the caching decisions for requests and responses
+	Policy Policy
+	// QueryOptions controls how query strings are normalized in cache keys
+	QueryOptions QueryOptions
+	// RangeOffsetLimit is how far into a resource a Range request that misses
+	// the cache can start and still fetch the whole resource upstream to store
+	// it. Range requests starting further in are passed upstream as they are,
+	// with the partial response stored. It defaults to 1MB, a negative limit
+	// means no limit.
+	RangeOffsetLimit int64
+	offline          int32
+	upstream         http.Handler
+	validator        *Validator
+	cache            Cache
+	flights          *flightGroup
+	revalidations    *flightGroup
+	indexLocks       *keyLocks
+	metrics          *metrics
 }
 
 func NewHandler(cache Cache, upstream http.Handler) *Handler {
 	return &Handler{
-		upstream:  upstream,
-		cache:     cache,
-		validator: &Validator{upstream},
-		Shared:    false,
+		upstream:         upstream,
+		cache:            cache,
+		validator:        &Validator{upstream},
+		Storeable:        defaultStoreable(),
+		Shared:           false,
+		CollapseTimeout:  defaultCollapseTimeout,
+		OfflineStatus:    defaultOfflineStatus,
+		RangeOffsetLimit: defaultRangeOffsetLimit,
+		flights:          newFlightGroup(),
+		revalidations:    newFlightGroup(),
+		indexLocks:       newKeyLocks(),
+		metrics:          newMetrics(),
 	}
 }
 
 func (h *Handler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
-	cReq, err := newCacheRequest(r)
+	cReq, err := h.newCacheRequest(r)
 	if err != nil {
 		http.Error(rw, "invalid request: "+err.Error(),
 			http.StatusBadRequest)
 		return
 	}
 
+	h.serveRequest(rw, cReq)
+}
+
+// serveRequest serves a request from the cache or upstream, making the caching
+// decisions for both the Handler and the Transport
+func (h *Handler) serveRequest(rw http.ResponseWriter, cReq *cacheRequest) {
+	if h.CacheStatus != "" {
+		sw := &cacheStatusWriter{ResponseWriter: rw, name: h.CacheStatus, status: cReq.status}
+		if DebugLogging {
+			sw.key = cReq.Key.String()
+		}
+		rw = sw
+	}
+
+	mw := &metricsWriter{ResponseWriter: rw}
+	defer func() {
+		if mw.result == "" {
+			mw.result = resultError
+		}
+		h.metrics.served(mw.result, mw.bytes)
+	}()
+	rw = mw
+
+	if h.IsOffline() {
+		h.serveOffline(rw, cReq)
+		return
+	}
+
 	if !cReq.isCacheable() {
 		debugf("request not cacheable")
+		if cReq.Method == "GET" || cReq.Method == "HEAD" {
+			cReq.status.forwarded(fwdRequest)
+		} else {
+			cReq.status.forwarded(fwdBypass)
+		}
 		rw.Header().Set(CacheHeader, "SKIP")
 		h.pipeUpstream(rw, cReq)
 		return
 	}
 
-	res, err := h.lookup(cReq)
+	res, key, err := h.lookup(cReq)
 	if err != nil && err != ErrNotFoundInCache {
 		http.Error(rw, "lookup error: "+err.Error(),
 			http.StatusInternalServerError)
@@ -93,11 +200,12 @@ func (h *Handler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 				http.StatusGatewayTimeout)
 			return
 		}
-		debugf("%s %s not in %s cache", r.Method, r.URL.String(), cacheType)
-		h.passUpstream(rw, cReq)
+		debugf("%s %s not in %s cache", cReq.Method, cReq.URL.String(), cacheType)
+		cReq.status.forwarded(h.missReason(cReq))
+		h.collapseUpstream(rw, cReq)
 		return
 	} else {
-		debugf("%s %s found in %s cache", r.Method, r.URL.String(), cacheType)
+		debugf("%s %s found in %s cache", cReq.Method, cReq.URL.String(), cacheType)
 	}
 
 	if h.needsValidation(res, cReq) {
@@ -107,13 +215,16 @@ func (h *Handler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		debugf("validating cached response")
-		if h.validator.Validate(r, res) {
-			debugf("response is valid")
-			h.cache.Freshen(res, cReq.Key.String())
+		if h.canServeWhileRevalidating(res, cReq) {
+			debugf("serving stale response while revalidating")
+			h.revalidate(cReq)
 		} else {
-			debugf("response is changed")
-			h.passUpstream(rw, cReq)
+			debugf("validating cached response")
+			var stale *Resource
+			if h.canServeIfError(res, cReq) {
+				stale = res
+			}
+			h.validateUpstream(rw, cReq, res, key, stale)
 			return
 		}
 	}
@@ -127,13 +238,73 @@ func (h *Handler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// SetOffline sets whether the handler is offline, in which case every request is
+// served from the cache regardless of freshness and upstream is never contacted
+func (h *Handler) SetOffline(offline bool) {
+	var v int32
+	if offline {
+		v = 1
+	}
+	atomic.StoreInt32(&h.offline, v)
+}
+
+// IsOffline returns whether the handler is offline
+func (h *Handler) IsOffline() bool {
+	return atomic.LoadInt32(&h.offline) == 1
+}
+
+// serveOffline serves a request from the cache as if it had only-if-cached and
+// an unlimited max-stale, or responds with OfflineStatus if it's not cached
+func (h *Handler) serveOffline(w http.ResponseWriter, r *cacheRequest) {
+	res, _, err := h.lookup(r)
+	if err == ErrNotFoundInCache {
+		debugf("%s %s not in cache while offline", r.Method, r.URL.String())
+		http.Error(w, "offline and key not in cache", h.OfflineStatus)
+		return
+	} else if err != nil {
+		http.Error(w, "lookup error: "+err.Error(),
+			http.StatusInternalServerError)
+		return
+	}
+
+	debugf("serving from cache while offline")
+	// http://httpwg.github.io/specs/rfc7234.html#warn.112
+	w.Header().Add("Warning", `112 - "Disconnected Operation"`)
+	res.Header().Set(CacheHeader, "HIT")
+	h.serveResource(res, w, r)
+
+	if err := res.Close(); err != nil {
+		errorf("Error closing resource: %s", err.Error())
+	}
+}
+
+// shared returns whether the cache is shared for a resource, as per the Policy
+func (h *Handler) shared(res *Resource, r *cacheRequest) bool {
+	if h.Policy != nil {
+		return h.Policy.Shared(r.Request, res, h.Shared)
+	}
+	return h.Shared
+}
+
 // freshness returns the duration that a requested resource will be fresh for
 func (h *Handler) freshness(res *Resource, r *cacheRequest) (time.Duration, error) {
-	maxAge, err := res.MaxAge(h.Shared)
+	maxAge, err := res.MaxAge(h.shared(res, r))
 	if err != nil {
 		return time.Duration(0), err
 	}
 
+	if ttl := h.negativeTTL(res.Status()); ttl > 0 && !res.HasExplicitExpiration() {
+		debugf("using negative ttl of %s", ttl)
+		maxAge = ttl
+	} else if hFresh := res.HeuristicFreshness(); hFresh > maxAge {
+		debugf("using heuristic freshness of %q", hFresh)
+		maxAge = hFresh
+	}
+
+	if h.Policy != nil {
+		maxAge = h.Policy.Lifetime(r.Request, res, maxAge)
+	}
+
 	if r.CacheControl.Has("max-age") {
 		reqMaxAge, err := r.CacheControl.Duration("max-age")
 		if err != nil {
@@ -155,16 +326,11 @@ func (h *Handler) freshness(res *Resource, r *cacheRequest) (time.Duration, erro
 		return time.Duration(0), nil
 	}
 
-	if hFresh := res.HeuristicFreshness(); hFresh > maxAge {
-		debugf("using heuristic freshness of %q", hFresh)
-		maxAge = hFresh
-	}
-
 	return maxAge - age, nil
 }
 
 func (h *Handler) needsValidation(res *Resource, r *cacheRequest) bool {
-	if res.MustValidate(h.Shared) {
+	if res.MustValidate(h.shared(res, r)) {
 		return true
 	}
 
@@ -202,87 +368,385 @@ func (h *Handler) needsValidation(res *Resource, r *cacheRequest) bool {
 	return freshness <= 0
 }
 
-// pipeUpstream makes the request via the upstream handler, the response is not stored or modified
-func (h *Handler) pipeUpstream(w http.ResponseWriter, r *cacheRequest) {
-	rw := newResponseStreamer(w)
-	rdr, err := rw.Stream.NextReader()
+// canServeWhileRevalidating returns whether a stale resource is within the
+// stale-while-revalidate period of the response, as per RFC 5861
+func (h *Handler) canServeWhileRevalidating(res *Resource, r *cacheRequest) bool {
+	if res.MustValidate(h.shared(res, r)) {
+		return false
+	}
+
+	cc, err := res.cacheControl()
+	if err != nil || !cc.Has("stale-while-revalidate") {
+		return false
+	}
+
+	window, err := cc.Duration("stale-while-revalidate")
+	if err != nil {
+		debugf("error parsing stale-while-revalidate: %s", err.Error())
+		return false
+	}
+
+	freshness, err := h.freshness(res, r)
 	if err != nil {
-		debugf("error creating next stream reader: %v", err)
-		w.Header().Set(CacheHeader, "SKIP")
-		h.upstream.ServeHTTP(w, r.Request)
+		return false
+	}
+
+	return (freshness * -1) <= window
+}
+
+// revalidate validates the cached resource for a request in the background,
+// freshening it if it's valid and fetching it again if not. Only one
+// revalidation is run for a key at a time.
+func (h *Handler) revalidate(r *cacheRequest) {
+	f, leader := h.revalidations.join(r.Key.String())
+	if !leader {
+		debugf("revalidation of %s already in progress", f.key)
 		return
 	}
-	defer rdr.Close()
 
-	debugf("piping request upstream")
+	// the original request is finished with once the stale response is served
+	req := cloneRequest(r.Request).WithContext(context.Background())
+	bgReq := r.withRequest(req)
+	bgReq.Time = Clock()
+	bgReq.status = &cacheStatus{}
+
+	Writes.Add(1)
 	go func() {
-		h.upstream.ServeHTTP(rw, r.Request)
-		rw.Stream.Close()
+		defer Writes.Done()
+		defer h.revalidations.finish(f, true)
+
+		res, key, err := h.lookup(bgReq)
+		if err != nil {
+			debugf("error looking up resource to revalidate: %v", err)
+			return
+		}
+
+		debugf("revalidating cached response in the background")
+		h.validateUpstream(nil, bgReq, res, key, nil)
 	}()
-	rw.WaitHeaders()
+}
+
+// validateUpstream makes a conditional request upstream for a cached resource and
+// the other variants stored alongside it, so that upstream can select any of them
+// as per RFC 7234 §4.3.1. A 304 updates the variants that it selects, which are
+// served from the cache, any other response is passed through and stored as per
+// passUpstream. If stale isn't nil, it is served in place of an upstream error.
+// If w is nil, as for a background revalidation, a 304 only freshens the variants
+// without serving any of them. The resource is closed once it's no longer needed.
+func (h *Handler) validateUpstream(w http.ResponseWriter, r *cacheRequest, res *Resource, key string, stale *Resource) {
+	background := w == nil
+	if background {
+		w = newDiscardResponseWriter()
+	}
+
+	variants, keys := []*Resource{res}, []string{key}
+	for _, k := range h.variantKeys(r, key) {
+		if v, err := h.cache.Retrieve(k); err == nil {
+			variants = append(variants, v)
+			keys = append(keys, k)
+		}
+	}
+
+	defer func() {
+		for _, v := range variants {
+			if err := v.Close(); err != nil {
+				errorf("Error closing resource: %s", err.Error())
+			}
+		}
+	}()
+
+	r.status.forwarded(fwdStale)
+	vr := r.withRequest(h.validator.request(r.Request, variants))
+
+	var valid bool
+	t := Clock()
+	rw := h.streamUpstream(w, vr, nil, func(status int, header http.Header) bool {
+		valid = status == http.StatusNotModified || unchanged(status, header, variants)
+		return valid || (stale != nil && staleIfErrorStatuses[status])
+	})
+
+	if !rw.intercepted {
+		debugf("response is changed")
+		return
+	} else if !valid {
+		debugf("validation failed with %d, serving stale response", rw.StatusCode)
+		h.serveStale(stale, w, r)
+		return
+	}
+
+	header := rw.Header()
+	header.Del(CacheHeader)
+	if age, err := correctedAge(header, t, Clock()); err == nil {
+		header.Set("Age", fmt.Sprintf("%.f", age.Seconds()))
+	}
+
+	selected := notModified(header, variants)
+	if len(selected) == 0 {
+		debugf("validation didn't select a stored response, fetching it again")
+		h.passUpstream(w, r, nil, stale)
+		return
+	}
+
+	for i, v := range variants {
+		for _, s := range selected {
+			if v == s {
+				h.cache.Freshen(v, keys[i])
+			}
+		}
+	}
+	r.status.stored = true
+
+	if background {
+		debugf("response is valid, freshened in the background")
+		return
+	}
+
+	// the variant for the request is served if it was selected
+	serve := selected[0]
+	for _, s := range selected {
+		if s == res {
+			serve = res
+		}
+	}
+
+	debugf("response is valid, serving from cache")
+	serve.Header().Set(CacheHeader, "HIT")
+	markRevalidated(w)
+	h.serveResource(serve, w, r)
+}
+
+// canServeIfError returns whether a stale resource can be served in place of an
+// upstream error, as per the stale-if-error directives of RFC 5861. The request
+// directive takes precedence over the response, which takes precedence over the
+// StaleIfError default.
+func (h *Handler) canServeIfError(res *Resource, r *cacheRequest) bool {
+	if res.MustValidate(h.shared(res, r)) || res.Status() >= 500 {
+		return false
+	}
+
+	cc, err := res.cacheControl()
+	if err != nil {
+		return false
+	}
+
+	window := h.StaleIfError
+	for _, directives := range []CacheControl{r.CacheControl, cc} {
+		if directives.Has("stale-if-error") {
+			if window, err = directives.Duration("stale-if-error"); err != nil {
+				debugf("error parsing stale-if-error: %s", err.Error())
+				return false
+			}
+			break
+		}
+	}
+
+	freshness, err := h.freshness(res, r)
+	if err != nil {
+		return false
+	}
+
+	return (freshness * -1) <= window
+}
+
+// serveStale serves a stale resource in place of an upstream error, it's left
+// for the caller to close
+func (h *Handler) serveStale(res *Resource, w http.ResponseWriter, r *cacheRequest) {
+	// http://httpwg.github.io/specs/rfc7234.html#warn.111
+	w.Header().Add("Warning", `111 - "Revalidation Failed"`)
+	res.Header().Set(CacheHeader, "STALE")
+	h.serveResource(res, w, r)
+}
+
+// pipeUpstream makes the request via the upstream handler, the response is not stored or modified
+func (h *Handler) pipeUpstream(w http.ResponseWriter, r *cacheRequest) {
+	rw := newResponseStreamer(w)
+
+	start := time.Now()
+	rw.OnHeader = func(rw *responseStreamer) {
+		h.metrics.upstreamLatency(time.Since(start))
+		r.status.fwdStatus = rw.StatusCode
+	}
+
+	debugf("piping request upstream")
+	h.upstream.ServeHTTP(rw, r.Request)
+	rw.WriteHeader(http.StatusOK)
 
 	if r.Method != "HEAD" && !r.isStateChanging() {
 		return
 	}
 
-	res := rw.Resource()
-	defer res.Close()
+	// just the headers!
+	res := NewResourceBytes(rw.StatusCode, nil, rw.header)
 
 	if r.Method == "HEAD" {
-		h.cache.Freshen(res, r.Key.ForMethod("GET").String())
+		if cached, key, err := h.lookupKey(h.methodKey(r, "GET"), r.Request); err == nil {
+			cached.Close()
+			h.cache.Freshen(res, key)
+		}
 	} else if res.IsNonErrorStatus() {
 		h.invalidateResource(res, r)
 	}
 }
 
-// passUpstream makes the request via the upstream handler and stores the result
-func (h *Handler) passUpstream(w http.ResponseWriter, r *cacheRequest) {
-	rw := newResponseStreamer(w)
-	rdr, err := rw.Stream.NextReader()
-	if err != nil {
-		debugf("error creating next stream reader: %v", err)
-		w.Header().Set(CacheHeader, "SKIP")
-		h.upstream.ServeHTTP(w, r.Request)
+// missReason returns why a request that wasn't found in the cache is forwarded,
+// which is a vary-miss if there are stored variants that didn't match it
+func (h *Handler) missReason(r *cacheRequest) string {
+	if h.CacheStatus != "" {
+		if _, err := h.readVariantIndex(r.Key); err == nil {
+			return fwdVaryMiss
+		}
+	}
+	return fwdURIMiss
+}
+
+// collapseUpstream passes a request upstream, unless there is already an upstream
+// request in-flight for the same key, in which case it waits for that request to be
+// stored and serves it from the cache
+func (h *Handler) collapseUpstream(w http.ResponseWriter, r *cacheRequest) {
+	if h.CollapseTimeout <= 0 {
+		h.fetchUpstream(w, r, nil)
 		return
 	}
 
-	t := Clock()
-	debugf("passing request upstream")
-	rw.Header().Set(CacheHeader, "MISS")
+	f, leader := h.flights.join(r.Key.String())
+	if leader {
+		h.fetchUpstream(w, r, f)
+		return
+	}
 
-	go func() {
-		h.upstream.ServeHTTP(rw, r.Request)
-		rw.Stream.Close()
-	}()
-	rw.WaitHeaders()
-	debugf("upstream responded headers in %s", Clock().Sub(t).String())
+	debugf("waiting on in-flight request for %s", f.key)
+	select {
+	case <-f.done:
+	case <-time.After(h.CollapseTimeout):
+		debugf("timed out waiting on in-flight request after %s", h.CollapseTimeout)
+		h.fetchUpstream(w, r, nil)
+		return
+	}
 
-	// just the headers!
-	res := NewResourceBytes(rw.StatusCode, nil, rw.Header())
-	if !h.isCacheable(res, r) {
-		rdr.Close()
-		debugf("resource is uncacheable")
-		rw.Header().Set(CacheHeader, "SKIP")
+	if !f.stored {
+		debugf("in-flight request wasn't stored")
+		h.fetchUpstream(w, r, nil)
 		return
 	}
-	b, err := ioutil.ReadAll(rdr)
-	rdr.Close()
+
+	res, _, err := h.lookup(r)
 	if err != nil {
-		debugf("error reading stream: %v", err)
-		rw.Header().Set(CacheHeader, "SKIP")
+		debugf("in-flight request not found in cache: %v", err)
+		h.fetchUpstream(w, r, nil)
 		return
 	}
-	debugf("full upstream response took %s", Clock().Sub(t).String())
-	res.ReadSeekCloser = &byteReadSeekCloser{bytes.NewReader(b)}
 
-	if age, err := correctedAge(res.Header(), t, Clock()); err == nil {
-		res.Header().Set("Age", strconv.Itoa(int(math.Ceil(age.Seconds()))))
-	} else {
-		debugf("error calculating corrected age: %s", err.Error())
+	debugf("serving collapsed request from cache")
+	r.status.collapsed = true
+	res.Header().Set(CacheHeader, "HIT")
+	h.serveResource(res, w, r)
+
+	if err := res.Close(); err != nil {
+		errorf("Error closing resource: %s", err.Error())
+	}
+}
+
+// passUpstream makes the request via the upstream handler and stores the result.
+// If f isn't nil, it is finished once the result is stored or found to be uncacheable.
+// If stale isn't nil, it is served in place of an upstream error, and isn't closed.
+func (h *Handler) passUpstream(w http.ResponseWriter, r *cacheRequest, f *flight, stale *Resource) {
+	rw := h.streamUpstream(w, r, f, func(status int, header http.Header) bool {
+		return stale != nil && staleIfErrorStatuses[status]
+	})
+
+	if rw.intercepted {
+		debugf("upstream failed with %d, serving stale response", rw.StatusCode)
+		h.serveStale(stale, w, r)
+	}
+}
+
+// streamUpstream makes the request via the upstream handler, streaming the response
+// through to w and storing it as per passUpstream. If intercept returns true for the
+// status and headers of the response, it's neither written to w nor stored, and f is finished so
+// the caller can respond instead.
+func (h *Handler) streamUpstream(w http.ResponseWriter, r *cacheRequest, f *flight, intercept func(status int, header http.Header) bool) *responseStreamer {
+	rw := newResponseStreamer(w)
+	rw.Header().Set(CacheHeader, "MISS")
+
+	t, start := Clock(), time.Now()
+	rw.OnHeader = func(rw *responseStreamer) {
+		debugf("upstream responded headers in %s", Clock().Sub(t).String())
+		h.metrics.upstreamLatency(time.Since(start))
+		r.status.fwdStatus = rw.StatusCode
+
+		if intercept(rw.StatusCode, rw.Header()) {
+			rw.Intercept()
+			return
+		}
+
+		if !h.isCacheable(NewResource(rw.StatusCode, nil, rw.Header()), r) {
+			debugf("resource is uncacheable")
+			rw.Header().Set(CacheHeader, "SKIP")
+			h.flights.finish(f, false)
+			return
+		}
+
+		if r.Method == "HEAD" {
+			// there's no body to store, HEAD requests are served from GET
+			debugf("not storing response to HEAD request")
+			h.flights.finish(f, false)
+			return
+		}
+
+		if age, err := correctedAge(rw.Header(), t, Clock()); err == nil {
+			rw.Header().Set("Age", strconv.Itoa(int(math.Ceil(age.Seconds()))))
+		} else {
+			debugf("error calculating corrected age: %s", err.Error())
+		}
+
+		rw.Header().Set(ProxyDateHeader, Clock().Format(http.TimeFormat))
+
+		var cw ResourceWriter
+		var err error
+		if rw.StatusCode == http.StatusPartialContent {
+			cw, err = h.partialWriter(NewResource(rw.StatusCode, nil, cloneHeader(rw.Header())), r)
+		} else {
+			cw, err = h.resourceWriter(NewResource(rw.StatusCode, nil, cloneHeader(rw.Header())), r)
+		}
+		if err != nil {
+			errorf("Error creating resource writer: %s", err.Error())
+			h.metrics.storeError()
+			rw.Header().Set(CacheHeader, "SKIP")
+			h.flights.finish(f, false)
+			return
+		}
+		rw.Tee(cw)
+		r.status.stored = true
+	}
+
+	defer func() {
+		// upstream handlers like httputil.ReverseProxy panic to abort a response
+		if err := recover(); err != nil {
+			rw.Abort()
+			h.flights.finish(f, false)
+			panic(err)
+		}
+	}()
+
+	debugf("passing request upstream")
+	h.upstream.ServeHTTP(rw, r.Request)
+	rw.WriteHeader(http.StatusOK)
+
+	if rw.intercepted {
+		h.flights.finish(f, false)
+		return rw
+	}
+
+	stored, err := rw.Commit()
+	if err != nil {
+		errorf("Error storing resource: %s", err.Error())
+		h.metrics.storeError()
+	} else if stored {
+		debugf("stored resource in %s", Clock().Sub(t))
 	}
 
-	rw.Header().Set(ProxyDateHeader, Clock().Format(http.TimeFormat))
-	h.storeResource(res, r)
+	h.flights.finish(f, stored)
+	return rw
 }
 
 // correctedAge adjusts the age of a resource for clock skew and travel time
@@ -313,6 +777,8 @@ func correctedAge(h http.Header, reqTime, respTime time.Time) (time.Duration, er
 	return currentAge, nil
 }
 
+// isCacheable returns whether a response to a request can be stored, as per
+// RFC 7234 §3 and the Policy
 func (h *Handler) isCacheable(res *Resource, r *cacheRequest) bool {
 	cc, err := res.cacheControl()
 	if err != nil {
@@ -320,28 +786,48 @@ func (h *Handler) isCacheable(res *Resource, r *cacheRequest) bool {
 		return false
 	}
 
-	if cc.Has("no-cache") || cc.Has("no-store") {
+	shared := h.shared(res, r)
+
+	if cc.Has("no-store") {
 		return false
 	}
 
-	if cc.Has("private") && len(cc["private"]) == 0 && h.Shared {
+	if cc.Has("private") && len(cc["private"]) == 0 && shared {
 		return false
 	}
 
-	if _, ok := storeable[res.Status()]; !ok {
+	if !h.isStoreable(res.Status()) {
 		return false
 	}
 
-	if r.Header.Get("Authorization") != "" && h.Shared {
+	if r.Header.Get("Authorization") != "" && shared {
 		return false
 	}
 
-	if res.Header().Get("Authorization") != "" && h.Shared &&
+	if res.Header().Get("Authorization") != "" && shared &&
 		!cc.Has("must-revalidate") && !cc.Has("s-maxage") {
 		return false
 	}
 
-	if res.HasExplicitExpiration() {
+	if _, ok := varyHeaders(res.Header().Get("Vary")); !ok {
+		return false
+	}
+
+	if res.Status() == http.StatusPartialContent && !partialStoreable(res.Header()) {
+		return false
+	}
+
+	cacheable := !cc.Has("no-cache") && h.hasFreshness(res, cc)
+	if h.Policy != nil {
+		return h.Policy.Cacheable(r.Request, res, cacheable)
+	}
+	return cacheable
+}
+
+// hasFreshness returns whether a resource has explicit, negative or heuristic
+// freshness, or can be validated
+func (h *Handler) hasFreshness(res *Resource, cc CacheControl) bool {
+	if res.HasExplicitExpiration() || h.negativeTTL(res.Status()) > 0 {
 		return true
 	}
 
@@ -358,6 +844,27 @@ func (h *Handler) isCacheable(res *Resource, r *cacheRequest) bool {
 	return false
 }
 
+// isStoreable returns whether a response status can be stored
+func (h *Handler) isStoreable(status int) bool {
+	statuses := h.Storeable
+	if statuses == nil {
+		statuses = storeable
+	}
+	return statuses[status] || h.negativeTTL(status) > 0
+}
+
+// negativeTTL returns how long a response with a negative status is fresh for
+// if it has no explicit freshness, or zero if it's not a negative status
+func (h *Handler) negativeTTL(status int) time.Duration {
+	switch {
+	case status == http.StatusNotFound || status == http.StatusGone:
+		return h.NegativeTTL
+	case status >= 500 && status < 600:
+		return h.ErrorTTL
+	}
+	return 0
+}
+
 func (h *Handler) serveResource(res *Resource, w http.ResponseWriter, req *cacheRequest) {
 	for key, headers := range res.Header() {
 		for _, header := range headers {
@@ -382,6 +889,9 @@ func (h *Handler) serveResource(res *Resource, w http.ResponseWriter, req *cache
 	if err != nil || freshness <= 0 {
 		w.Header().Add("Warning", `110 - "Response is Stale"`)
 	}
+	if err == nil {
+		req.status.ttl = &freshness
+	}
 
 	debugf("resource is %s old, updating age from %s",
 		age.String(), w.Header().Get("Age"))
@@ -389,81 +899,168 @@ func (h *Handler) serveResource(res *Resource, w http.ResponseWriter, req *cache
 	w.Header().Set("Age", fmt.Sprintf("%.f", math.Floor(age.Seconds())))
 	w.Header().Set("Via", res.Via())
 
+	if status := checkPreconditions(req.Request, res); status != 0 {
+		debugf("precondition responded with %d", status)
+		writePrecondition(w, status)
+		return
+	}
+
+	if h.serveRanges(res, w, req) {
+		return
+	}
+
 	// hacky handler for non-ok statuses
 	if res.Status() != http.StatusOK {
 		w.WriteHeader(res.Status())
 		io.Copy(w, res)
 	} else {
-		http.ServeContent(w, req.Request, "", res.LastModified(), res)
+		// preconditions and ranges are handled above
+		r := cloneRequest(req.Request)
+		r.Header.Del("Range")
+		r.Header.Del("If-Range")
+		for _, header := range conditionalHeaders {
+			r.Header.Del(header)
+		}
+		http.ServeContent(w, r, "", res.LastModified(), res)
 	}
 }
 
+// invalidateResource invalidates the effective request URI of a state changing
+// request, along with any same-origin URIs in the Location and Content-Location
+// headers of the response, as per RFC 7234 §4.4
 func (h *Handler) invalidateResource(res *Resource, r *cacheRequest) {
-	Writes.Add(1)
+	urls := []*url.URL{r.URL}
+
+	for _, header := range []string{"Location", "Content-Location"} {
+		if location := res.Header().Get(header); location != "" {
+			if u, ok := sameOriginURL(r.Request, location); ok {
+				urls = append(urls, u)
+			} else {
+				debugf("not invalidating %s %q", header, location)
+			}
+		}
+	}
 
-	go func() {
-		defer Writes.Done()
-		debugf("invalidating resource %+v", res)
-	}()
+	var keys []string
+	for _, u := range urls {
+		for _, method := range []string{"GET", "HEAD"} {
+			k := h.urlKey(r.Request, method, u)
+			keys = append(keys, k.String(), variantIndexKey(k), partialIndexKey(k))
+			keys = append(keys, h.pieceKeys(k)...)
+		}
+	}
+
+	debugf("invalidating resources %+v", keys)
+	h.cache.Invalidate(keys...)
 }
 
-func (h *Handler) storeResource(res *Resource, r *cacheRequest) {
-	Writes.Add(1)
+// sameOriginURL resolves a location against the URL of a request, it returns
+// false if the location can't be parsed or is on a different host. The URL
+// returned is in the same form as the request's, either absolute or just a path.
+func sameOriginURL(r *http.Request, location string) (*url.URL, bool) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, false
+	}
 
-	go func() {
-		defer Writes.Done()
-		t := Clock()
-		keys := []string{r.Key.String()}
-		headers := res.Header()
+	host := r.URL.Host
+	if host == "" {
+		host = r.Host
+	}
 
-		if h.Shared {
-			res.RemovePrivateHeaders()
+	if u.IsAbs() || u.Host != "" {
+		if !strings.EqualFold(u.Host, host) {
+			return nil, false
 		}
-
-		// store a secondary vary version
-		if vary := headers.Get("Vary"); vary != "" {
-			keys = append(keys, r.Key.Vary(vary, r.Request).String())
+		if r.URL.Host == "" {
+			u.Scheme, u.Host, u.User = "", "", nil
 		}
+	}
+
+	return r.URL.ResolveReference(u), true
+}
+
+// resourceWriter returns a ResourceWriter for storing a resource for a request.
+// Resources with a Vary header are stored as a variant of the request's key.
+func (h *Handler) resourceWriter(res *Resource, r *cacheRequest) (ResourceWriter, error) {
+	key := r.Key.String()
 
-		if err := h.cache.Store(res, keys...); err != nil {
-			errorf("storing resources %#v failed with error: %s", keys, err.Error())
+	if h.shared(res, r) {
+		res.RemovePrivateHeaders()
+	}
+	if h.Policy != nil {
+		h.Policy.StoreHeader(r.Request, res.Header())
+	}
+
+	if vary := res.Header().Get("Vary"); vary != "" {
+		headers, _ := varyHeaders(vary)
+		key = r.Key.Vary(vary, r.Request).String()
+		if err := h.storeVariant(r.Key, headers, key); err != nil {
+			return nil, err
 		}
+	} else if _, err := h.readVariantIndex(r.Key); err == nil {
+		// the variant index would hide the resource
+		h.cache.Invalidate(variantIndexKey(r.Key))
+	}
 
-		debugf("stored resources %+v in %s", keys, Clock().Sub(t))
-	}()
+	debugf("storing resource %s", key)
+	return h.cache.Writer(res.Status(), res.Header(), key)
 }
 
-// lookupResource finds the best matching Resource for the
-// request, or nil and ErrNotFoundInCache if none is found
-func (h *Handler) lookup(req *cacheRequest) (*Resource, error) {
-	res, err := h.cache.Retrieve(req.Key.String())
+// lookup finds the best matching Resource for the request, along with the key
+// it's stored under, or ErrNotFoundInCache if none is found
+func (h *Handler) lookup(req *cacheRequest) (*Resource, string, error) {
+	res, key, err := h.lookupKey(req.Key, req.Request)
 
 	// HEAD requests can possibly be served from GET
 	if err == ErrNotFoundInCache && req.Method == "HEAD" {
-		res, err = h.cache.Retrieve(req.Key.ForMethod("GET").String())
+		res, key, err = h.lookupKey(h.methodKey(req, "GET"), req.Request)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 
 		if res.HasExplicitExpiration() && req.isCacheable() {
 			debugf("using cached GET request for serving HEAD")
-			return res, nil
-		} else {
-			return nil, ErrNotFoundInCache
+			return res, key, nil
 		}
-	} else if err != nil {
-		return res, err
+
+		res.Close()
+		return nil, "", ErrNotFoundInCache
 	}
 
-	// Secondary lookup for Vary
-	if vary := res.Header().Get("Vary"); vary != "" {
-		res, err = h.cache.Retrieve(req.Key.Vary(vary, req.Request).String())
-		if err != nil {
-			return res, err
+	return res, key, err
+}
+
+// lookupKey finds the Resource stored for a key, selecting the variant that
+// matches the request if there is a variant index for it
+func (h *Handler) lookupKey(k Key, r *http.Request) (*Resource, string, error) {
+	index, err := h.readVariantIndex(k)
+	if err == nil {
+		for _, key := range index.match(k, r) {
+			if res, err := h.cache.Retrieve(key); err == nil {
+				return res, key, nil
+			} else if err != ErrNotFoundInCache {
+				return nil, "", err
+			}
 		}
+		return nil, "", ErrNotFoundInCache
+	} else if err != ErrNotFoundInCache {
+		return nil, "", err
 	}
 
-	return res, nil
+	key := k.String()
+	res, err := h.cache.Retrieve(key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// resources with a Vary header are only served via the variant index
+	if res.Header().Get("Vary") != "" {
+		res.Close()
+		return nil, "", ErrNotFoundInCache
+	}
+
+	return res, key, nil
 }
 
 type cacheRequest struct {
@@ -471,28 +1068,65 @@ type cacheRequest struct {
 	Key          Key
 	Time         time.Time
 	CacheControl CacheControl
+	status       *cacheStatus
 }
 
-func newCacheRequest(r *http.Request) (*cacheRequest, error) {
-	cc, err := ParseCacheControl(r.Header.Get("Cache-Control"))
-	if err != nil {
-		return nil, err
-	}
-
+func (h *Handler) newCacheRequest(r *http.Request) (*cacheRequest, error) {
 	if r.Proto == "HTTP/1.1" && r.Host == "" {
 		return nil, errors.New("Host header can't be empty")
 	}
 
 	return &cacheRequest{
 		Request:      r,
-		Key:          NewRequestKey(r),
+		Key:          h.requestKey(r),
 		Time:         Clock(),
-		CacheControl: cc,
+		CacheControl: parseCacheControlLenient(strings.Join(r.Header["Cache-Control"], ", ")),
+		status:       &cacheStatus{},
 	}, nil
 }
 
+// requestKey returns the Key for a request from the Handler's KeyFunc, with
+// its QueryOptions applied
+func (h *Handler) requestKey(r *http.Request) Key {
+	var k Key
+	if h.KeyFunc != nil {
+		k = h.KeyFunc(r)
+	} else {
+		k = NewRequestKey(r)
+	}
+	k.u = *h.QueryOptions.apply(&k.u)
+	return k
+}
+
+// methodKey returns the Key for a request as if it had a different method, such
+// as the GET request that a HEAD request can be served from
+func (h *Handler) methodKey(r *cacheRequest, method string) Key {
+	r2 := cloneRequest(r.Request)
+	r2.Method = method
+	return h.requestKey(r2)
+}
+
+// urlKey returns the Key for a request as if it had a different method and URL,
+// such as the URLs that are invalidated by a state changing request
+func (h *Handler) urlKey(r *http.Request, method string, u *url.URL) Key {
+	r2 := cloneRequest(r)
+	r2.Method = method
+	r2.URL = u
+	r2.Header.Del("Content-Location")
+	return h.requestKey(r2)
+}
+
+// withRequest returns a copy of the cacheRequest for making a different request
+// upstream, such as a conditional one, that shares its cacheStatus
+func (r *cacheRequest) withRequest(req *http.Request) *cacheRequest {
+	r2 := *r
+	r2.Request = req
+	return &r2
+}
+
 func (r *cacheRequest) isStateChanging() bool {
-	if !(r.Method == "POST" || r.Method == "PUT" || r.Method == "DELETE") {
+	switch r.Method {
+	case "POST", "PUT", "DELETE", "PATCH":
 		return true
 	}
 
@@ -504,12 +1138,6 @@ func (r *cacheRequest) isCacheable() bool {
 		return false
 	}
 
-	if r.Header.Get("If-Match") != "" ||
-		r.Header.Get("If-Unmodified-Since") != "" ||
-		r.Header.Get("If-Range") != "" {
-		return false
-	}
-
 	if maxAge, ok := r.CacheControl.Get("max-age"); ok && maxAge == "0" {
 		return false
 	}
@@ -521,70 +1149,127 @@ func (r *cacheRequest) isCacheable() bool {
 	return true
 }
 
+// responseStreamer passes a response from upstream through to a ResponseWriter,
+// optionally teeing the body into a ResourceWriter as it goes
+type responseStreamer struct {
+	http.ResponseWriter
+	StatusCode int
+	// OnHeader is called before the headers are written, it can modify them,
+	// set a ResourceWriter with Tee or stop the response with Intercept
+	OnHeader    func(rw *responseStreamer)
+	header      http.Header
+	wroteHeader bool
+	intercepted bool
+	cw          ResourceWriter
+}
+
 func newResponseStreamer(w http.ResponseWriter) *responseStreamer {
-	strm, err := stream.NewStream("responseBuffer", stream.NewMemFS())
-	if err != nil {
-		panic(err)
-	}
 	return &responseStreamer{
 		ResponseWriter: w,
-		Stream:         strm,
-		C:              make(chan struct{}),
+		header:         cloneHeader(w.Header()),
 	}
 }
 
-type responseStreamer struct {
-	StatusCode int
-	http.ResponseWriter
-	*stream.Stream
-	// C will be closed by WriteHeader to signal the headers' writing.
-	C chan struct{}
+// Header returns the headers from upstream, they are copied to the underlying
+// ResponseWriter when WriteHeader is called
+func (rw *responseStreamer) Header() http.Header {
+	if rw.wroteHeader && !rw.intercepted {
+		return rw.ResponseWriter.Header()
+	}
+	return rw.header
+}
+
+// Intercept stops the response from being written to the underlying ResponseWriter
+func (rw *responseStreamer) Intercept() {
+	rw.intercepted = true
+}
+
+// Tee sets a ResourceWriter that the body is written to
+func (rw *responseStreamer) Tee(cw ResourceWriter) {
+	rw.cw = cw
 }
 
-// WaitHeaders returns iff and when WriteHeader has been called.
-func (rw *responseStreamer) WaitHeaders() {
-	for range rw.C {
+// Commit closes the ResourceWriter, returning whether a resource was stored
+func (rw *responseStreamer) Commit() (bool, error) {
+	if rw.cw == nil {
+		return false, nil
 	}
+	err := rw.cw.Close()
+	rw.cw = nil
+	return err == nil, err
 }
 
+// Abort discards anything written to the ResourceWriter
+func (rw *responseStreamer) Abort() {
+	if rw.cw != nil {
+		if err := rw.cw.Abort(); err != nil {
+			debugf("error aborting resource writer: %s", err.Error())
+		}
+		rw.cw = nil
+	}
+}
+
+// WriteHeader is a no-op after the first call
 func (rw *responseStreamer) WriteHeader(status int) {
-	defer close(rw.C)
+	if rw.wroteHeader {
+		return
+	}
 	rw.StatusCode = status
+
+	if rw.OnHeader != nil {
+		rw.OnHeader(rw)
+	}
+
+	rw.wroteHeader = true
+	if rw.intercepted {
+		return
+	}
+
+	for key, headers := range rw.header {
+		rw.ResponseWriter.Header()[key] = headers
+	}
+
 	rw.ResponseWriter.WriteHeader(status)
 }
 
 func (rw *responseStreamer) Write(b []byte) (int, error) {
-	rw.Stream.Write(b)
-	return rw.ResponseWriter.Write(b)
-}
-func (rw *responseStreamer) Close() error {
-	return rw.Stream.Close()
-}
+	rw.WriteHeader(http.StatusOK)
 
-// Resource returns a copy of the responseStreamer as a Resource object
-func (rw *responseStreamer) Resource() *Resource {
-	r, err := rw.Stream.NextReader()
-	if err == nil {
-		b, err := ioutil.ReadAll(r)
-		r.Close()
-		if err == nil {
-			return NewResourceBytes(rw.StatusCode, b, rw.Header())
+	if rw.cw != nil {
+		if _, err := rw.cw.Write(b); err != nil {
+			debugf("error writing to resource writer: %s", err.Error())
+			rw.Abort()
 		}
 	}
-	return &Resource{
-		header:         rw.Header(),
-		statusCode:     rw.StatusCode,
-		ReadSeekCloser: errReadSeekCloser{err},
+
+	if rw.intercepted {
+		return len(b), nil
+	}
+
+	n, err := rw.ResponseWriter.Write(b)
+	if err != nil {
+		// the body stored would be incomplete
+		rw.Abort()
+	}
+	return n, err
+}
+
+func (rw *responseStreamer) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok && !rw.intercepted {
+		f.Flush()
 	}
 }
 
-type errReadSeekCloser struct {
-	err error
+// discardResponseWriter is a http.ResponseWriter for upstream requests made in the
+// background, where the response is only stored
+type discardResponseWriter struct {
+	header http.Header
 }
 
-func (e errReadSeekCloser) Error() string {
-	return e.err.Error()
+func newDiscardResponseWriter() *discardResponseWriter {
+	return &discardResponseWriter{header: http.Header{}}
 }
-func (e errReadSeekCloser) Close() error                       { return e.err }
-func (e errReadSeekCloser) Read(_ []byte) (int, error)         { return 0, e.err }
-func (e errReadSeekCloser) Seek(_ int64, _ int) (int64, error) { return 0, e.err }
+
+func (rw *discardResponseWriter) Header() http.Header         { return rw.header }
+func (rw *discardResponseWriter) WriteHeader(_ int)           {}
+func (rw *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
@@ -0,0 +1,404 @@
+package httpcache_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lox/httpcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type slowUpstream struct {
+	CacheControl string
+	Delay        time.Duration
+	requests     int32
+}
+
+func (u *slowUpstream) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	atomic.AddInt32(&u.requests, 1)
+	time.Sleep(u.Delay)
+	rw.Header().Set("Cache-Control", u.CacheControl)
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("llamas"))
+}
+
+func concurrentGets(handler http.Handler, n int) []*httptest.ResponseRecorder {
+	var wg sync.WaitGroup
+	recs := make([]*httptest.ResponseRecorder, n)
+
+	for i := range recs {
+		recs[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(rec *httptest.ResponseRecorder) {
+			defer wg.Done()
+			handler.ServeHTTP(rec, newRequest("GET", "http://example.org/collapsed"))
+		}(recs[i])
+	}
+
+	wg.Wait()
+	httpcache.Writes.Wait()
+	return recs
+}
+
+func TestCollapsedForwardingOfConcurrentMisses(t *testing.T) {
+	upstream := &slowUpstream{CacheControl: "max-age=60", Delay: time.Millisecond * 50}
+	handler := httpcache.NewHandler(httpcache.NewMemoryCache(), upstream)
+
+	for _, rec := range concurrentGets(handler, 20) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "llamas", rec.Body.String())
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&upstream.requests))
+}
+
+func TestCollapsedForwardingFallsBackWhenUncacheable(t *testing.T) {
+	upstream := &slowUpstream{CacheControl: "no-store", Delay: time.Millisecond * 50}
+	handler := httpcache.NewHandler(httpcache.NewMemoryCache(), upstream)
+
+	for _, rec := range concurrentGets(handler, 5) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "llamas", rec.Body.String())
+		assert.Equal(t, "SKIP", rec.Header().Get(httpcache.CacheHeader))
+	}
+
+	assert.Equal(t, int32(5), atomic.LoadInt32(&upstream.requests))
+}
+
+func TestCollapsedForwardingTimeout(t *testing.T) {
+	upstream := &slowUpstream{CacheControl: "max-age=60", Delay: time.Millisecond * 200}
+	handler := httpcache.NewHandler(httpcache.NewMemoryCache(), upstream)
+	handler.CollapseTimeout = time.Millisecond
+
+	for _, rec := range concurrentGets(handler, 5) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "llamas", rec.Body.String())
+	}
+
+	assert.True(t, atomic.LoadInt32(&upstream.requests) > 1)
+}
+
+type chunkedUpstream struct {
+	Chunks   []string
+	requests int32
+}
+
+func (u *chunkedUpstream) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	atomic.AddInt32(&u.requests, 1)
+	rw.Header().Set("Cache-Control", "max-age=60")
+	for _, chunk := range u.Chunks {
+		rw.Write([]byte(chunk))
+		rw.(http.Flusher).Flush()
+	}
+}
+
+func TestStreamingResponseIsStored(t *testing.T) {
+	upstream := &chunkedUpstream{Chunks: []string{"llamas ", "are ", "streamed"}}
+	handler := httpcache.NewHandler(httpcache.NewMemoryCache(), upstream)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, newRequest("GET", "http://example.org/streamed"))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "MISS", rec.Header().Get(httpcache.CacheHeader))
+	assert.Equal(t, "llamas are streamed", rec.Body.String())
+	assert.True(t, rec.Flushed)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, newRequest("GET", "http://example.org/streamed"))
+	assert.Equal(t, "HIT", rec.Header().Get(httpcache.CacheHeader))
+	assert.Equal(t, "llamas are streamed", rec.Body.String())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&upstream.requests))
+}
+
+type varyUpstream struct {
+	requests int32
+}
+
+func (u *varyUpstream) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	atomic.AddInt32(&u.requests, 1)
+	time.Sleep(time.Millisecond * 10)
+	rw.Header().Set("Cache-Control", "max-age=60")
+	rw.Header().Set("Vary", "Accept-Language")
+	rw.Write([]byte(req.Header.Get("Accept-Language")))
+}
+
+func TestConcurrentVariantsAreAllStored(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cache, err := httpcache.NewDiskCache(dir)
+	require.NoError(t, err)
+
+	upstream := &varyUpstream{}
+	handler := httpcache.NewHandler(cache, upstream)
+	handler.CollapseTimeout = 0
+
+	var langs []string
+	for i := 0; i < 32; i++ {
+		langs = append(langs, fmt.Sprintf("lang-%d", i))
+	}
+	get := func(lang string) *httptest.ResponseRecorder {
+		r := newRequest("GET", "http://example.org/varied")
+		r.Header.Set("Accept-Language", lang)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec
+	}
+
+	var wg sync.WaitGroup
+	for _, lang := range langs {
+		wg.Add(1)
+		go func(lang string) {
+			defer wg.Done()
+			get(lang)
+		}(lang)
+	}
+	wg.Wait()
+	httpcache.Writes.Wait()
+
+	for _, lang := range langs {
+		rec := get(lang)
+		assert.Equal(t, "HIT", rec.Header().Get(httpcache.CacheHeader), lang)
+		assert.Equal(t, lang, rec.Body.String())
+	}
+	assert.Equal(t, int32(len(langs)), atomic.LoadInt32(&upstream.requests))
+}
+
+type blockingUpstream struct {
+	release chan struct{}
+}
+
+func (u *blockingUpstream) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Cache-Control", "max-age=60")
+	rw.Header().Set("Content-Length", "12")
+	rw.Write([]byte("llamas"))
+	rw.(http.Flusher).Flush()
+	<-u.release
+	rw.Write([]byte("alpaca"))
+}
+
+type notifyingRecorder struct {
+	*httptest.ResponseRecorder
+	written chan struct{}
+}
+
+func (r *notifyingRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseRecorder.Write(b)
+	select {
+	case r.written <- struct{}{}:
+	default:
+	}
+	return n, err
+}
+
+func TestRangeMissIsServedWhileStored(t *testing.T) {
+	upstream := &blockingUpstream{release: make(chan struct{})}
+	handler := httpcache.NewHandler(httpcache.NewMemoryCache(), upstream)
+
+	rec := &notifyingRecorder{httptest.NewRecorder(), make(chan struct{}, 1)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r := newRequest("GET", "http://example.org/blocking")
+		r.Header.Set("Range", "bytes=2-4")
+		handler.ServeHTTP(rec, r)
+	}()
+
+	select {
+	case <-rec.written:
+	case <-time.After(time.Second):
+		t.Fatal("range wasn't served before the whole resource was fetched")
+	}
+	close(upstream.release)
+	<-done
+	httpcache.Writes.Wait()
+
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "MISS", rec.Header().Get(httpcache.CacheHeader))
+	assert.Equal(t, "bytes 2-4/12", rec.Header().Get("Content-Range"))
+	assert.Equal(t, "ama", rec.Body.String())
+
+	r := newRequest("GET", "http://example.org/blocking")
+	r.Header.Set("Range", "bytes=6-")
+	rec2 := httptest.NewRecorder()
+	handler.ServeHTTP(rec2, r)
+	assert.Equal(t, "HIT", rec2.Header().Get(httpcache.CacheHeader))
+	assert.Equal(t, "alpaca", rec2.Body.String())
+}
+
+func TestPartialResponseWithMissingPieceIsRefetched(t *testing.T) {
+	cache := httpcache.NewMemoryCache()
+	upstream := &upstreamServer{
+		Body:         []byte("llamas"),
+		CacheControl: "max-age=60",
+		Etag:         `"llamas"`,
+		Now:          time.Now(),
+	}
+	httpcache.Clock = func() time.Time {
+		return upstream.Now
+	}
+
+	handler := httpcache.NewHandler(cache, upstream)
+	handler.RangeOffsetLimit = 0
+	client := &client{handler, handler}
+
+	assert.Equal(t, "MISS", client.get("/", "Range: bytes=0-1").cacheStatus)
+	assert.Equal(t, "MISS", client.get("/", "Range: bytes=2-3").cacheStatus)
+	assert.Equal(t, "HIT", client.get("/", "Range: bytes=1-3").cacheStatus)
+
+	cache.Invalidate(pieceKey(t, cache, "http://example.org/", 0, 1))
+
+	r := client.get("/", "Range: bytes=1-3")
+	assert.Equal(t, http.StatusPartialContent, r.Code)
+	assert.Equal(t, "MISS", r.cacheStatus)
+	assert.Equal(t, "lam", string(r.body))
+	assert.Equal(t, 3, upstream.requests)
+}
+
+func TestPartialResponseInvalidatesCoveredPieces(t *testing.T) {
+	cache := httpcache.NewMemoryCache()
+	upstream := &upstreamServer{
+		Body:         []byte("llamas"),
+		CacheControl: "max-age=60",
+		Etag:         `"llamas"`,
+		Now:          time.Now(),
+	}
+	httpcache.Clock = func() time.Time {
+		return upstream.Now
+	}
+
+	handler := httpcache.NewHandler(cache, upstream)
+	handler.RangeOffsetLimit = 0
+	client := &client{handler, handler}
+
+	assert.Equal(t, "MISS", client.get("/", "Range: bytes=1-2").cacheStatus)
+	key := pieceKey(t, cache, "http://example.org/", 1, 2)
+	assert.Equal(t, "MISS", client.get("/", "Range: bytes=0-3").cacheStatus)
+
+	res, err := cache.Retrieve(key)
+	require.NoError(t, err)
+	defer res.Close()
+	assert.True(t, res.IsStale())
+}
+
+// pieceKey returns the key of the stored piece of a url from start to end, as
+// listed in its partial index
+func pieceKey(t *testing.T, cache httpcache.Cache, url string, start, end int64) string {
+	key := httpcache.NewRequestKey(newRequest("GET", url)).String()
+	res, err := cache.Retrieve(key + "::partial")
+	require.NoError(t, err)
+	defer res.Close()
+
+	b, err := ioutil.ReadAll(res)
+	require.NoError(t, err)
+	for _, line := range strings.Split(string(b), "\n") {
+		if f := strings.Split(line, "\t"); len(f) == 4 && f[0] == "piece" &&
+			f[1] == strconv.FormatInt(start, 10) && f[2] == strconv.FormatInt(end-start+1, 10) {
+			return f[3]
+		}
+	}
+	t.Fatalf("no piece %d-%d in partial index:\n%s", start, end, b)
+	return ""
+}
+
+func TestPartialResponseWithChangedPieceIsRefetched(t *testing.T) {
+	cache := httpcache.NewMemoryCache()
+	upstream := &upstreamServer{
+		Body:         []byte("llamas"),
+		CacheControl: "max-age=60",
+		Etag:         `"llamas"`,
+		Now:          time.Now(),
+	}
+	httpcache.Clock = func() time.Time {
+		return upstream.Now
+	}
+
+	handler := httpcache.NewHandler(cache, upstream)
+	handler.RangeOffsetLimit = 0
+	client := &client{handler, handler}
+
+	assert.Equal(t, "MISS", client.get("/", "Range: bytes=0-1").cacheStatus)
+	assert.Equal(t, "MISS", client.get("/", "Range: bytes=2-3").cacheStatus)
+
+	// a piece from another version of the resource is never combined with the index
+	key := pieceKey(t, cache, "http://example.org/", 0, 1)
+	res, err := cache.Retrieve(key)
+	require.NoError(t, err)
+	header := res.Header()
+	res.Close()
+	header.Set("Etag", `"alpacas"`)
+	require.NoError(t, cache.Store(httpcache.NewResourceBytes(http.StatusPartialContent, []byte("al"), header), key))
+
+	r := client.get("/", "Range: bytes=1-3")
+	assert.Equal(t, http.StatusPartialContent, r.Code)
+	assert.Equal(t, "MISS", r.cacheStatus)
+	assert.Equal(t, "lam", string(r.body))
+	assert.Equal(t, 3, upstream.requests)
+}
+
+type readCountingCache struct {
+	httpcache.Cache
+	reads int32
+}
+
+func (c *readCountingCache) Retrieve(key string) (*httpcache.Resource, error) {
+	res, err := c.Cache.Retrieve(key)
+	if err != nil {
+		return nil, err
+	}
+	return httpcache.NewResource(res.Status(), &countingBody{res, &c.reads}, res.Header()), nil
+}
+
+type countingBody struct {
+	httpcache.ReadSeekCloser
+	reads *int32
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	atomic.AddInt32(b.reads, 1)
+	return b.ReadSeekCloser.Read(p)
+}
+
+func TestBackgroundRevalidationDoesNotReadBody(t *testing.T) {
+	cache := &readCountingCache{Cache: httpcache.NewMemoryCache()}
+	upstream := &upstreamServer{
+		Body:         []byte("llamas"),
+		CacheControl: "max-age=60, stale-while-revalidate=30",
+		Etag:         `"llamas"`,
+		Now:          time.Now(),
+	}
+	httpcache.Clock = func() time.Time {
+		return upstream.Now
+	}
+
+	handler := httpcache.NewHandler(cache, upstream)
+	client := &client{handler, handler}
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+
+	upstream.timeTravel(time.Second * 70)
+	r := client.get("/")
+	assert.Equal(t, "HIT", r.cacheStatus)
+	assert.Equal(t, "llamas", string(r.body))
+
+	assert.Equal(t, 2, upstream.requests)
+	staleReads := atomic.LoadInt32(&cache.reads)
+
+	// serving the freshened response reads the body as often as serving the
+	// stale one did, as the background 304 shouldn't have read it at all
+	r = client.get("/")
+	assert.Equal(t, "HIT", r.cacheStatus)
+	assert.Empty(t, r.Header()["Warning"])
+	assert.Equal(t, 2, upstream.requests)
+	assert.Equal(t, staleReads, atomic.LoadInt32(&cache.reads)-staleReads)
+}
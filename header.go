@@ -24,3 +24,12 @@ func intHeader(key string, h http.Header) (int, error) {
 		return 0, errNoHeader
 	}
 }
+
+// cloneHeader returns a copy of a http.Header that can be modified independently
+func cloneHeader(h http.Header) http.Header {
+	h2 := make(http.Header, len(h))
+	for key, values := range h {
+		h2[key] = append([]string(nil), values...)
+	}
+	return h2
+}
@@ -94,6 +94,8 @@ func (l *ResponseLogger) writeLog(req *http.Request, respWr *responseWriter) {
 		cacheStatus = "\x1b[32;1mHIT\x1b[0m"
 	} else if strings.HasPrefix(cacheStatus, "MISS") {
 		cacheStatus = "\x1b[31;1mMISS\x1b[0m"
+	} else if strings.HasPrefix(cacheStatus, "STALE") {
+		cacheStatus = "\x1b[35;1mSTALE\x1b[0m"
 	} else {
 		cacheStatus = "\x1b[33;1mSKIP\x1b[0m"
 	}
@@ -0,0 +1,126 @@
+// Package lru tracks the entries of a Cache for eviction, it's shared by the
+// Cache implementations of httpcache and its subpackages
+package lru
+
+import (
+	"container/list"
+	"sync"
+)
+
+// LRU tracks the size and recency of entries in a cache, so that the least
+// recently used entries can be evicted once the cache grows beyond its limits
+type LRU struct {
+	mu         sync.Mutex
+	maxBytes   int64
+	maxEntries int
+	bytes      int64
+	evictions  int64
+	ll         *list.List
+	entries    map[string]*list.Element
+}
+
+type lruEntry struct {
+	id   string
+	size int64
+}
+
+// Stats are the number and total size of the entries and the number evicted
+type Stats struct {
+	Entries   int64
+	Bytes     int64
+	Evictions int64
+}
+
+// New returns an LRU with the given limits, zero means no limit
+func New(maxBytes int64, maxEntries int) *LRU {
+	return &LRU{
+		maxBytes:   maxBytes,
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+// Add records an entry as most recently used and returns the ids of the
+// entries that need to be evicted to bring the cache back within its limits
+func (l *LRU) Add(id string, size int64) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if el, ok := l.entries[id]; ok {
+		e := el.Value.(*lruEntry)
+		l.bytes += size - e.size
+		e.size = size
+		l.ll.MoveToFront(el)
+	} else {
+		l.entries[id] = l.ll.PushFront(&lruEntry{id: id, size: size})
+		l.bytes += size
+	}
+
+	return l.evict()
+}
+
+// Touch marks an entry as most recently used
+func (l *LRU) Touch(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if el, ok := l.entries[id]; ok {
+		l.ll.MoveToFront(el)
+	}
+}
+
+// Has returns whether an entry is tracked, an entry that was returned by Add
+// for eviction isn't tracked unless it's been added again since
+func (l *LRU) Has(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, ok := l.entries[id]
+	return ok
+}
+
+// Stats returns the number and total size of the entries and the number evicted
+func (l *LRU) Stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return Stats{
+		Entries:   int64(l.ll.Len()),
+		Bytes:     l.bytes,
+		Evictions: l.evictions,
+	}
+}
+
+// evict must be called with the lock held
+func (l *LRU) evict() []string {
+	var evicted []string
+
+	for l.overLimit() {
+		el := l.ll.Back()
+		if el == nil {
+			break
+		}
+		evicted = append(evicted, el.Value.(*lruEntry).id)
+		l.removeElement(el)
+		l.evictions++
+	}
+
+	return evicted
+}
+
+func (l *LRU) overLimit() bool {
+	if l.maxEntries > 0 && l.ll.Len() > l.maxEntries {
+		return true
+	}
+	if l.maxBytes > 0 && l.bytes > l.maxBytes {
+		return true
+	}
+	return false
+}
+
+func (l *LRU) removeElement(el *list.Element) {
+	e := l.ll.Remove(el).(*lruEntry)
+	delete(l.entries, e.id)
+	l.bytes -= e.size
+}
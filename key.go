@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"path"
+	"sort"
 	"strings"
 )
 
@@ -14,6 +16,7 @@ type Key struct {
 	header http.Header
 	u      url.URL
 	vary   []string
+	extra  []string
 }
 
 // NewKey returns a new Key instance
@@ -52,21 +55,79 @@ func (k Key) ForMethod(method string) Key {
 	return k2
 }
 
-// Vary returns a Key that is varied on particular headers in a http.Request
+// Extend returns a Key that also includes the given values, such as a tenant ID
+// from a request header, for use in a Handler's KeyFunc
+func (k Key) Extend(values ...string) Key {
+	k2 := k
+	k2.extra = append(append([]string{}, k.extra...), values...)
+	return k2
+}
+
+// Vary returns a Key that is varied on particular headers in a http.Request.
+// Header names are case-insensitive and values are compared with the whitespace
+// around list elements removed. A Vary of "*" never matches, so it returns a Key
+// that is unique to this call.
 func (k Key) Vary(varyHeader string, r *http.Request) Key {
 	k2 := k
+	k2.vary = []string{}
+
+	headers, ok := varyHeaders(varyHeader)
+	if !ok {
+		k2.vary = append(k2.vary, "*="+tempName())
+		return k2
+	}
 
-	for _, header := range strings.Split(varyHeader, ", ") {
-		k2.vary = append(k2.vary, header+"="+r.Header.Get(header))
+	for _, header := range headers {
+		k2.vary = append(k2.vary, header+"="+normalizeHeaderValues(r.Header[header]))
 	}
 
 	return k2
 }
 
+// varyHeaders parses a Vary header into a sorted list of canonical header names,
+// it returns false if the Vary header is "*"
+func varyHeaders(varyHeader string) ([]string, bool) {
+	seen := map[string]bool{}
+	headers := []string{}
+
+	for _, header := range strings.Split(varyHeader, ",") {
+		header = strings.TrimSpace(header)
+		if header == "*" {
+			return nil, false
+		}
+		header = http.CanonicalHeaderKey(header)
+		if header != "" && !seen[header] {
+			seen[header] = true
+			headers = append(headers, header)
+		}
+	}
+
+	sort.Strings(headers)
+	return headers, true
+}
+
+// normalizeHeaderValues combines the values of a header into a single list with
+// no whitespace around its elements
+func normalizeHeaderValues(values []string) string {
+	var elems []string
+
+	for _, value := range values {
+		for _, elem := range strings.Split(value, ",") {
+			elems = append(elems, strings.TrimSpace(elem))
+		}
+	}
+
+	return strings.Join(elems, ",")
+}
+
 func (k Key) String() string {
-	URL := strings.ToLower(canonicalURL(&k.u).String())
 	b := &bytes.Buffer{}
-	b.WriteString(fmt.Sprintf("%s:%s", k.method, URL))
+	b.WriteString(fmt.Sprintf("%s:%s", k.method, canonicalURL(&k.u)))
+
+	// canonical URLs never have a fragment, so # can't be confused with the URL
+	for _, v := range k.extra {
+		b.WriteString("#" + url.PathEscape(v))
+	}
 
 	if len(k.vary) > 0 {
 		b.WriteString("::")
@@ -78,6 +139,174 @@ func (k Key) String() string {
 	return b.String()
 }
 
-func canonicalURL(u *url.URL) *url.URL {
-	return u
+// canonicalURL returns a URL in a normal form as per RFC 3986 §6.2.2, so that
+// equivalent URLs have the same Key. The scheme and host are lowercased, default
+// ports are removed, percent-encoding is normalized and dot-segments are removed
+// from the path. The fragment is never part of a Key.
+func canonicalURL(u *url.URL) string {
+	c := *u
+	c.Scheme = strings.ToLower(c.Scheme)
+	c.Host = canonicalHost(c.Scheme, c.Host)
+	c.Fragment, c.RawFragment = "", ""
+	c.RawQuery = normalizeEscapes(c.RawQuery)
+
+	if c.Opaque == "" {
+		escaped := normalizeEscapes(u.EscapedPath())
+		if strings.HasPrefix(escaped, "/") {
+			escaped = removeDotSegments(escaped)
+		}
+		if unescaped, err := url.PathUnescape(escaped); err == nil {
+			c.Path, c.RawPath = unescaped, escaped
+		}
+	}
+
+	return c.String()
+}
+
+// canonicalHost lowercases a host and removes the port if it's empty or the
+// default for the scheme
+func canonicalHost(scheme, host string) string {
+	host = strings.ToLower(host)
+
+	if i := strings.LastIndex(host, ":"); i != -1 && !strings.Contains(host[i:], "]") {
+		switch port := host[i+1:]; {
+		case port == "",
+			port == "80" && scheme == "http",
+			port == "443" && scheme == "https":
+			return host[:i]
+		}
+	}
+
+	return host
+}
+
+// normalizeEscapes decodes percent-encoded unreserved characters, uppercases the
+// hex digits of the remaining percent-encodings and encodes any characters that
+// aren't allowed in a URL
+func normalizeEscapes(s string) string {
+	b := &bytes.Buffer{}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]):
+			decoded := unhex(s[i+1])<<4 | unhex(s[i+2])
+			if isUnreserved(decoded) {
+				b.WriteByte(decoded)
+			} else {
+				fmt.Fprintf(b, "%%%02X", decoded)
+			}
+			i += 2
+		case c == '%' || isUnreserved(c) || strings.IndexByte(":/?#[]@!$&'()*+,;=", c) != -1:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+// removeDotSegments removes the "." and ".." segments from an absolute path as
+// per RFC 3986 §5.2.4, unlike path.Clean it preserves empty segments and
+// trailing slashes
+func removeDotSegments(p string) string {
+	segments := strings.Split(p, "/")
+	out := make([]string, 0, len(segments))
+
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		switch segment {
+		case ".":
+		case "..":
+			if len(out) > 1 {
+				out = out[:len(out)-1]
+			}
+		default:
+			out = append(out, segment)
+			continue
+		}
+		if last {
+			out = append(out, "")
+		}
+	}
+
+	return strings.Join(out, "/")
+}
+
+// QueryOptions controls how the query string of a URL is normalized in a Key.
+// Normalization is the same for looking up, storing and invalidating resources.
+type QueryOptions struct {
+	// Sort orders query parameters by name, so that the order they're given in
+	// doesn't matter. The order of repeated parameters is preserved.
+	Sort bool
+	// Ignore is a list of query parameter names that are removed, such as
+	// tracking parameters and cache busters. Names can be patterns as per
+	// path.Match, e.g "utm_*".
+	Ignore []string
+}
+
+// apply returns a copy of a URL with a normalized query string
+func (o QueryOptions) apply(u *url.URL) *url.URL {
+	if (!o.Sort && len(o.Ignore) == 0) || u.RawQuery == "" {
+		return u
+	}
+
+	var params []string
+	for _, param := range strings.Split(u.RawQuery, "&") {
+		if param != "" && !o.ignored(param) {
+			params = append(params, param)
+		}
+	}
+
+	if o.Sort {
+		sort.SliceStable(params, func(i, j int) bool {
+			return queryName(params[i]) < queryName(params[j])
+		})
+	}
+
+	u2 := *u
+	u2.RawQuery = strings.Join(params, "&")
+	return &u2
+}
+
+func (o QueryOptions) ignored(param string) bool {
+	name := queryName(param)
+	for _, pattern := range o.Ignore {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// queryName returns the unescaped name of a query parameter
+func queryName(param string) string {
+	if i := strings.IndexByte(param, '='); i != -1 {
+		param = param[:i]
+	}
+	if name, err := url.QueryUnescape(param); err == nil {
+		return name
+	}
+	return param
 }
@@ -58,3 +58,65 @@ func TestRequestKeyWithIllegalContentLocation(t *testing.T) {
 
 	assert.Equal(t, k1.String(), k2.String())
 }
+
+func TestVaryKeyNormalizesHeaders(t *testing.T) {
+	r1 := newRequest("GET", "http://x.org/test", "Llamas-1: a, b", "Llamas-2: c")
+	r2 := newRequest("GET", "http://x.org/test", "Llamas-2: c", "Llamas-1: a,b")
+
+	k1 := httpcache.NewRequestKey(r1).Vary("Llamas-1, Llamas-2", r1)
+	k2 := httpcache.NewRequestKey(r2).Vary("llamas-2,llamas-1", r2)
+
+	assert.Equal(t, k1.String(), k2.String())
+}
+
+func TestVaryKeyStarNeverMatches(t *testing.T) {
+	r := newRequest("GET", "http://x.org/test")
+
+	k1 := httpcache.NewRequestKey(r).Vary("*", r)
+	k2 := httpcache.NewRequestKey(r).Vary("*", r)
+
+	assert.NotEqual(t, k1.String(), k2.String())
+}
+
+func TestKeyCanonicalizesURLs(t *testing.T) {
+	for _, urls := range [][2]string{
+		{"HTTP://X.Org/test", "http://x.org/test"},
+		{"http://x.org:80/test", "http://x.org/test"},
+		{"https://x.org:443/test", "https://x.org/test"},
+		{"http://x.org:/test", "http://x.org/test"},
+		{"http://x.org/%7Ellamas/%61", "http://x.org/~llamas/a"},
+		{"http://x.org/a%2fb?q=%c3%a9", "http://x.org/a%2Fb?q=%C3%A9"},
+		{"http://x.org/a/./b/../c/", "http://x.org/a/c/"},
+		{"http://x.org/a/%2E%2E/b", "http://x.org/b"},
+		{"http://x.org/test#fragment", "http://x.org/test"},
+	} {
+		k1 := httpcache.NewKey("GET", mustParseUrl(urls[0]), nil)
+		k2 := httpcache.NewKey("GET", mustParseUrl(urls[1]), nil)
+		assert.Equal(t, k2.String(), k1.String(), urls[0])
+	}
+}
+
+func TestKeyDistinguishesURLs(t *testing.T) {
+	for _, urls := range [][2]string{
+		{"http://x.org/Test", "http://x.org/test"},
+		{"http://x.org:8080/test", "http://x.org/test"},
+		{"https://x.org:80/test", "https://x.org/test"},
+		{"http://x.org/a%2Fb", "http://x.org/a/b"},
+		{"http://x.org/a//b", "http://x.org/a/b"},
+		{"http://x.org/test/", "http://x.org/test"},
+		{"http://x.org/?b=2&a=1", "http://x.org/?a=1&b=2"},
+	} {
+		k1 := httpcache.NewKey("GET", mustParseUrl(urls[0]), nil)
+		k2 := httpcache.NewKey("GET", mustParseUrl(urls[1]), nil)
+		assert.NotEqual(t, k2.String(), k1.String(), urls[0])
+	}
+}
+
+func TestExtendedKeysDiffer(t *testing.T) {
+	k := httpcache.NewKey("GET", mustParseUrl("http://x.org/test"), nil)
+
+	assert.NotEqual(t, k.String(), k.Extend("a").String())
+	assert.NotEqual(t, k.Extend("a").String(), k.Extend("b").String())
+	assert.NotEqual(t, k.Extend("a", "b").String(), k.Extend("a#b").String())
+	assert.Equal(t, k.Extend("a").Extend("b").String(), k.Extend("a", "b").String())
+}
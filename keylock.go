@@ -0,0 +1,64 @@
+package httpcache
+
+import "sync"
+
+// keyLocks provides a read/write lock per key, which only exists while it's
+// held or waited on
+type keyLocks struct {
+	sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.RWMutex
+	refs int
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{locks: map[string]*keyLock{}}
+}
+
+// lock acquires the write lock for a key and returns a func that releases it
+func (l *keyLocks) lock(key string) func() {
+	kl := l.acquire(key)
+	kl.Lock()
+
+	return func() {
+		kl.Unlock()
+		l.release(key, kl)
+	}
+}
+
+// rlock acquires the read lock for a key and returns a func that releases it
+func (l *keyLocks) rlock(key string) func() {
+	kl := l.acquire(key)
+	kl.RLock()
+
+	return func() {
+		kl.RUnlock()
+		l.release(key, kl)
+	}
+}
+
+func (l *keyLocks) acquire(key string) *keyLock {
+	l.Lock()
+	defer l.Unlock()
+
+	kl, ok := l.locks[key]
+	if !ok {
+		kl = &keyLock{}
+		l.locks[key] = kl
+	}
+	kl.refs++
+	return kl
+}
+
+func (l *keyLocks) release(key string, kl *keyLock) {
+	l.Lock()
+	defer l.Unlock()
+
+	kl.refs--
+	if kl.refs == 0 {
+		delete(l.locks, key)
+	}
+}
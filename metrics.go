@@ -0,0 +1,178 @@
+package httpcache
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Results that requests are counted under, the result of a request is its
+// CacheHeader, except for hits that were validated upstream first. Responses
+// without a CacheHeader, like lookup errors and requests that can only be served
+// from the cache but aren't in it, are counted as errors.
+const (
+	resultHit         = "hit"
+	resultMiss        = "miss"
+	resultSkip        = "skip"
+	resultStale       = "stale"
+	resultRevalidated = "revalidated"
+	resultError       = "error"
+)
+
+var results = []string{resultHit, resultMiss, resultSkip, resultStale, resultRevalidated, resultError}
+
+// latencyBuckets are the upper bounds in seconds of the upstream latency histogram
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metrics counts what a Handler does, it's exposed by Handler.MetricsHandler
+type metrics struct {
+	sync.Mutex
+	requests      map[string]int64
+	cacheBytes    int64
+	upstreamBytes int64
+	storeErrors   int64
+	latency       []int64
+	latencyCount  int64
+	latencySum    time.Duration
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		requests: map[string]int64{},
+		latency:  make([]int64, len(latencyBuckets)),
+	}
+	for _, result := range results {
+		m.requests[result] = 0
+	}
+	return m
+}
+
+// served counts a request with a result and the bytes of body served for it
+func (m *metrics) served(result string, bytes int64) {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.requests[result]; !ok {
+		return
+	}
+
+	m.requests[result]++
+	switch result {
+	case resultError:
+		// error bodies come from neither the cache nor upstream
+	case resultMiss, resultSkip:
+		m.upstreamBytes += bytes
+	default:
+		m.cacheBytes += bytes
+	}
+}
+
+// upstreamLatency records how long upstream took to respond with headers
+func (m *metrics) upstreamLatency(d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+
+	for i, le := range latencyBuckets {
+		if d.Seconds() <= le {
+			m.latency[i]++
+		}
+	}
+	m.latencyCount++
+	m.latencySum += d
+}
+
+// storeError counts an error storing a resource
+func (m *metrics) storeError() {
+	m.Lock()
+	defer m.Unlock()
+
+	m.storeErrors++
+}
+
+// writeTo writes the metrics in the Prometheus text exposition format
+func (m *metrics) writeTo(w io.Writer, cache Cache) {
+	m.Lock()
+	defer m.Unlock()
+
+	writeHelp(w, "httpcache_requests_total", "counter", "Requests served, by cache result.")
+	for _, result := range results {
+		fmt.Fprintf(w, "httpcache_requests_total{result=%q} %d\n", result, m.requests[result])
+	}
+
+	writeHelp(w, "httpcache_served_bytes_total", "counter", "Bytes of response bodies served, by where they came from.")
+	fmt.Fprintf(w, "httpcache_served_bytes_total{source=\"cache\"} %d\n", m.cacheBytes)
+	fmt.Fprintf(w, "httpcache_served_bytes_total{source=\"upstream\"} %d\n", m.upstreamBytes)
+
+	writeHelp(w, "httpcache_upstream_latency_seconds", "histogram", "Time taken for upstream to respond with headers.")
+	for i, le := range latencyBuckets {
+		fmt.Fprintf(w, "httpcache_upstream_latency_seconds_bucket{le=\"%g\"} %d\n", le, m.latency[i])
+	}
+	fmt.Fprintf(w, "httpcache_upstream_latency_seconds_bucket{le=\"+Inf\"} %d\n", m.latencyCount)
+	fmt.Fprintf(w, "httpcache_upstream_latency_seconds_sum %g\n", m.latencySum.Seconds())
+	fmt.Fprintf(w, "httpcache_upstream_latency_seconds_count %d\n", m.latencyCount)
+
+	writeHelp(w, "httpcache_store_errors_total", "counter", "Errors storing resources in the cache.")
+	fmt.Fprintf(w, "httpcache_store_errors_total %d\n", m.storeErrors)
+
+	if sc, ok := cache.(StatsCache); ok {
+		stats := sc.Stats()
+		writeHelp(w, "httpcache_cache_entries", "gauge", "Entries stored in the cache.")
+		fmt.Fprintf(w, "httpcache_cache_entries %d\n", stats.Entries)
+		writeHelp(w, "httpcache_cache_bytes", "gauge", "Bytes of resources stored in the cache.")
+		fmt.Fprintf(w, "httpcache_cache_bytes %d\n", stats.Bytes)
+		writeHelp(w, "httpcache_cache_evictions_total", "counter", "Entries evicted from the cache.")
+		fmt.Fprintf(w, "httpcache_cache_evictions_total %d\n", stats.Evictions)
+	}
+}
+
+func writeHelp(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// MetricsHandler returns a http.Handler that serves metrics about the Handler and
+// its Cache in the Prometheus text exposition format
+func (h *Handler) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		h.metrics.writeTo(w, h.cache)
+	})
+}
+
+// metricsWriter counts the result of a request and the bytes served for it
+type metricsWriter struct {
+	http.ResponseWriter
+	result string
+	bytes  int64
+}
+
+func (w *metricsWriter) WriteHeader(status int) {
+	if w.result == "" {
+		w.result = strings.ToLower(w.Header().Get(CacheHeader))
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metricsWriter) Write(b []byte) (int, error) {
+	if w.result == "" {
+		w.result = strings.ToLower(w.Header().Get(CacheHeader))
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *metricsWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// markRevalidated counts a response as revalidated rather than a hit
+func markRevalidated(w http.ResponseWriter) {
+	if mw, ok := w.(*metricsWriter); ok && mw.result == "" {
+		mw.result = resultRevalidated
+	}
+}
@@ -0,0 +1,111 @@
+package httpcache_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lox/httpcache"
+	"github.com/stretchr/testify/assert"
+)
+
+func scrapeMetrics(h *httpcache.Handler) (string, string) {
+	rec := httptest.NewRecorder()
+	h.MetricsHandler().ServeHTTP(rec, newRequest("GET", "http://example.org/metrics"))
+	return rec.Body.String(), rec.HeaderMap.Get("Content-Type")
+}
+
+func TestMetricsCountResults(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Etag = `"llamas"`
+
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+	assert.Equal(t, "HIT", client.get("/").cacheStatus)
+	assert.Equal(t, "SKIP", client.get("/", cc("no-store")).cacheStatus)
+
+	upstream.timeTravel(time.Second * 90)
+	assert.Equal(t, "HIT", client.get("/").cacheStatus)
+
+	metrics, contentType := scrapeMetrics(client.cacheHandler)
+	assert.True(t, strings.HasPrefix(contentType, "text/plain; version=0.0.4"))
+
+	for _, line := range []string{
+		`httpcache_requests_total{result="hit"} 1`,
+		`httpcache_requests_total{result="miss"} 1`,
+		`httpcache_requests_total{result="skip"} 1`,
+		`httpcache_requests_total{result="stale"} 0`,
+		`httpcache_requests_total{result="revalidated"} 1`,
+		`httpcache_served_bytes_total{source="cache"} 12`,
+		`httpcache_served_bytes_total{source="upstream"} 12`,
+		`httpcache_upstream_latency_seconds_bucket{le="+Inf"} 3`,
+		`httpcache_upstream_latency_seconds_count 3`,
+		`httpcache_store_errors_total 0`,
+		`httpcache_cache_entries 1`,
+		`httpcache_cache_evictions_total 0`,
+	} {
+		assert.Contains(t, metrics, line+"\n")
+	}
+	assert.NotContains(t, metrics, "httpcache_cache_bytes 0\n")
+}
+
+func TestMetricsCountEvictions(t *testing.T) {
+	upstream := &slowUpstream{CacheControl: "max-age=60"}
+	handler := httpcache.NewHandler(httpcache.NewLimitedMemoryCache(0, 2), upstream)
+
+	for _, path := range []string{"/a", "/b", "/c"} {
+		handler.ServeHTTP(httptest.NewRecorder(), newRequest("GET", "http://example.org"+path))
+		httpcache.Writes.Wait()
+	}
+
+	metrics, _ := scrapeMetrics(handler)
+	assert.Contains(t, metrics, "httpcache_cache_entries 2\n")
+	assert.Contains(t, metrics, "httpcache_cache_evictions_total 1\n")
+	assert.Contains(t, metrics, "# TYPE httpcache_cache_evictions_total counter\n")
+	assert.Contains(t, metrics, `httpcache_requests_total{result="miss"} 3`)
+}
+
+func TestMetricsHeadMissIsNotAStoreError(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+
+	assert.Equal(t, "MISS", client.head("/").cacheStatus)
+	assert.Equal(t, "MISS", client.head("/").cacheStatus)
+
+	metrics, _ := scrapeMetrics(client.cacheHandler)
+	assert.Contains(t, metrics, "httpcache_store_errors_total 0\n")
+	assert.Equal(t, 2, upstream.requests)
+}
+
+func TestMetricsUnstoreablePartialResponseIsNotAStoreError(t *testing.T) {
+	client, upstream := testSetup()
+	client.cacheHandler.RangeOffsetLimit = 0
+	upstream.CacheControl = "max-age=60"
+	upstream.Etag = `W/"llamas"`
+
+	assert.Equal(t, "SKIP", client.get("/", "Range: bytes=0-2").cacheStatus)
+
+	metrics, _ := scrapeMetrics(client.cacheHandler)
+	assert.Contains(t, metrics, "httpcache_store_errors_total 0\n")
+	assert.Contains(t, metrics, `httpcache_requests_total{result="skip"} 1`)
+}
+
+func TestMetricsCountResponsesWithoutCacheStatusAsErrors(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+
+	r := client.get("/", cc("only-if-cached"))
+	assert.Equal(t, http.StatusGatewayTimeout, r.Code)
+	assert.Equal(t, "", r.cacheStatus)
+
+	client.cacheHandler.SetOffline(true)
+	assert.Equal(t, "", client.get("/offline").cacheStatus)
+
+	metrics, _ := scrapeMetrics(client.cacheHandler)
+	assert.Contains(t, metrics, `httpcache_requests_total{result="error"} 2`+"\n")
+	assert.Contains(t, metrics, `httpcache_served_bytes_total{source="cache"} 0`+"\n")
+	assert.Contains(t, metrics, `httpcache_served_bytes_total{source="upstream"} 0`+"\n")
+	assert.Equal(t, 0, upstream.requests)
+}
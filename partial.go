@@ -0,0 +1,492 @@
+package httpcache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// partialIndex lists the pieces of a resource that have been stored from 206
+// responses. Pieces are only combined if they have the same strong validator,
+// as per RFC 7233 §3.3. Once they cover the whole resource, it's stored as a
+// complete 200 response and the index is invalidated.
+type partialIndex struct {
+	size      int64
+	validator string
+	header    http.Header
+	pieces    []piece
+}
+
+// piece is a stored range of a resource
+type piece struct {
+	httpRange
+	key string
+}
+
+// partialIndexKey returns the cache key that the partial index for a key is stored under
+func partialIndexKey(k Key) string {
+	return k.String() + "::partial"
+}
+
+// pieceKey returns the cache key that a piece of a resource is stored under,
+// which includes a hash of its validator so that pieces of different versions
+// of the resource never overwrite each other
+func pieceKey(k Key, validator string, ra httpRange) string {
+	return fmt.Sprintf("%s:%s:%d-%d", partialIndexKey(k), hashKey(validator), ra.start, ra.start+ra.length-1)
+}
+
+// partialValidator returns the strong validator of a response, or false if it
+// doesn't have one
+func partialValidator(h http.Header) (string, bool) {
+	if h.Get("Etag") != "" {
+		etag, err := ParseEntityTag(h.Get("Etag"))
+		if err != nil || etag.Weak {
+			return "", false
+		}
+		return "etag:" + etag.String(), true
+	}
+
+	if _, ok := strongLastModified(h); !ok {
+		return "", false
+	}
+	return "last-modified:" + h.Get("Last-Modified"), true
+}
+
+// partialStoreable returns whether a 206 response can be stored as a piece of a
+// resource, which needs a single range with a known size, a strong validator
+// and no Vary
+func partialStoreable(h http.Header) bool {
+	if _, _, err := parseContentRange(h.Get("Content-Range")); err != nil {
+		return false
+	}
+	_, ok := partialValidator(h)
+	return ok && h.Get("Vary") == ""
+}
+
+// parseContentRange parses a Content-Range header with a known size
+func parseContentRange(s string) (httpRange, int64, error) {
+	var start, end, size int64
+	if _, err := fmt.Sscanf(s, "bytes %d-%d/%d", &start, &end, &size); err != nil {
+		return httpRange{}, 0, fmt.Errorf("unsupported Content-Range %q", s)
+	}
+	if start < 0 || end < start || end >= size {
+		return httpRange{}, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	return httpRange{start: start, length: end - start + 1}, size, nil
+}
+
+// add adds a piece to the index, dropping any pieces that it covers. It returns
+// the keys of the dropped pieces, other than one the piece replaced.
+func (idx *partialIndex) add(p piece) []string {
+	pieces := []piece{p}
+	var dropped []string
+
+	for _, existing := range idx.pieces {
+		if existing.start < p.start || existing.start+existing.length > p.start+p.length {
+			pieces = append(pieces, existing)
+		} else if existing.key != p.key {
+			dropped = append(dropped, existing.key)
+		}
+	}
+
+	sort.Slice(pieces, func(i, j int) bool {
+		return pieces[i].start < pieces[j].start
+	})
+	idx.pieces = pieces
+	return dropped
+}
+
+// keys returns the keys of the pieces
+func (idx *partialIndex) keys() []string {
+	var keys []string
+	for _, p := range idx.pieces {
+		keys = append(keys, p.key)
+	}
+	return keys
+}
+
+// covered returns the ranges covered by the pieces, with ranges that overlap
+// or touch merged together
+func (idx *partialIndex) covered() []httpRange {
+	var ranges []httpRange
+
+	for _, p := range idx.pieces {
+		if n := len(ranges); n > 0 && p.start <= ranges[n-1].start+ranges[n-1].length {
+			last := &ranges[n-1]
+			if end := p.start + p.length; end > last.start+last.length {
+				last.length = end - last.start
+			}
+			continue
+		}
+		ranges = append(ranges, p.httpRange)
+	}
+
+	return ranges
+}
+
+// covers returns whether a range is covered by the pieces
+func (idx *partialIndex) covers(ra httpRange) bool {
+	for _, c := range idx.covered() {
+		if ra.start >= c.start && ra.start+ra.length <= c.start+c.length {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns whether a stored piece has the validator of the index
+func (idx *partialIndex) matches(res *Resource) bool {
+	validator, ok := partialValidator(res.Header())
+	return ok && validator == idx.validator
+}
+
+// complete returns whether the pieces cover the whole resource
+func (idx *partialIndex) complete() bool {
+	return idx.covers(httpRange{start: 0, length: idx.size})
+}
+
+func (idx *partialIndex) bytes() []byte {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "size\t%d\n", idx.size)
+	fmt.Fprintf(b, "validator\t%s\n", idx.validator)
+	for _, p := range idx.pieces {
+		fmt.Fprintf(b, "piece\t%d\t%d\t%s\n", p.start, p.length, p.key)
+	}
+	return b.Bytes()
+}
+
+func parsePartialIndex(r io.Reader, h http.Header) (*partialIndex, error) {
+	idx := &partialIndex{header: h}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		f := strings.Split(scanner.Text(), "\t")
+
+		var err error
+		switch {
+		case f[0] == "size" && len(f) == 2:
+			idx.size, err = strconv.ParseInt(f[1], 10, 64)
+		case f[0] == "validator" && len(f) == 2:
+			idx.validator = f[1]
+		case f[0] == "piece" && len(f) == 4:
+			p := piece{key: f[3]}
+			if p.start, err = strconv.ParseInt(f[1], 10, 64); err == nil {
+				p.length, err = strconv.ParseInt(f[2], 10, 64)
+			}
+			idx.pieces = append(idx.pieces, p)
+		default:
+			err = fmt.Errorf("malformed partial index line: %q", scanner.Text())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return idx, scanner.Err()
+}
+
+// readPartialIndex reads the partial index for a key, or returns
+// ErrNotFoundInCache if there isn't one or it has been invalidated
+func (h *Handler) readPartialIndex(k Key) (*partialIndex, error) {
+	res, err := h.cache.Retrieve(partialIndexKey(k))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	if res.IsStale() {
+		return nil, ErrNotFoundInCache
+	}
+
+	idx, err := parsePartialIndex(res, res.Header())
+	if err != nil {
+		return nil, err
+	}
+
+	idx.header.Set("Content-Length", strconv.FormatInt(idx.size, 10))
+	return idx, nil
+}
+
+// pieceKeys returns the keys of the pieces in the partial index for a key
+func (h *Handler) pieceKeys(k Key) []string {
+	idx, err := h.readPartialIndex(k)
+	if err != nil {
+		return nil
+	}
+	return idx.keys()
+}
+
+// storePartialIndex stores the index with the headers of the resource, except
+// for the Content-Length which is restored from its size when it's read
+func (h *Handler) storePartialIndex(k Key, idx *partialIndex) error {
+	header := cloneHeader(idx.header)
+	header.Del("Content-Length")
+
+	return h.cache.Store(NewResourceBytes(http.StatusOK, idx.bytes(), header), partialIndexKey(k))
+}
+
+// partialWriter returns a ResourceWriter for storing a 206 response as a piece
+// of a resource, which is added to the partial index when it's closed. The
+// response must be storeable as per partialStoreable.
+func (h *Handler) partialWriter(res *Resource, r *cacheRequest) (ResourceWriter, error) {
+	ra, size, err := parseContentRange(res.Header().Get("Content-Range"))
+	if err != nil {
+		return nil, err
+	}
+	validator, _ := partialValidator(res.Header())
+
+	if h.shared(res, r) {
+		res.RemovePrivateHeaders()
+	}
+	if h.Policy != nil {
+		h.Policy.StoreHeader(r.Request, res.Header())
+	}
+
+	p := piece{httpRange: ra, key: pieceKey(r.Key, validator, ra)}
+
+	debugf("storing partial resource %s", p.key)
+	cw, err := h.cache.Writer(res.Status(), res.Header(), p.key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := cloneHeader(res.Header())
+	header.Del("Content-Range")
+	header.Set("Content-Length", strconv.FormatInt(size, 10))
+
+	return &partialResourceWriter{ResourceWriter: cw, commit: func() error {
+		return h.addPiece(r, &partialIndex{size: size, validator: validator, header: header}, p)
+	}}, nil
+}
+
+// addPiece adds a stored piece to the partial index for a request, replacing the
+// index if the piece doesn't have the same validator. If the pieces then cover
+// the whole resource, they are combined into a complete resource. Pieces that
+// are no longer in the index are invalidated.
+func (h *Handler) addPiece(r *cacheRequest, update *partialIndex, p piece) error {
+	unlock := h.indexLocks.lock(partialIndexKey(r.Key))
+	defer unlock()
+
+	var dropped []string
+	idx, err := h.readPartialIndex(r.Key)
+	if err == nil && (idx.validator != update.validator || idx.size != update.size) {
+		dropped = idx.keys()
+		idx = update
+	} else if err == ErrNotFoundInCache {
+		idx, err = update, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	idx.header = update.header
+	dropped = append(dropped, idx.add(p)...)
+	if len(dropped) > 0 {
+		h.cache.Invalidate(withoutKey(dropped, p.key)...)
+	}
+
+	if !idx.complete() {
+		return h.storePartialIndex(r.Key, idx)
+	}
+
+	debugf("partial resource is complete, storing it whole")
+	res := NewResource(http.StatusOK, nil, cloneHeader(idx.header))
+	cw, err := h.resourceWriter(res, r)
+	if err != nil {
+		return err
+	}
+
+	body := &partialBody{cache: h.cache, idx: idx}
+	defer body.Close()
+
+	if _, err := io.Copy(cw, body); err != nil {
+		cw.Abort()
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+
+	h.cache.Invalidate(append(idx.keys(), partialIndexKey(r.Key))...)
+	return nil
+}
+
+// withoutKey returns the keys other than key
+func withoutKey(keys []string, key string) []string {
+	var without []string
+	for _, k := range keys {
+		if k != key {
+			without = append(without, k)
+		}
+	}
+	return without
+}
+
+// piecesStored returns whether all of the pieces in the index are still stored
+// with its validator and haven't been invalidated
+func (h *Handler) piecesStored(idx *partialIndex) bool {
+	for _, p := range idx.pieces {
+		res, err := h.cache.Retrieve(p.key)
+		if err != nil {
+			debugf("piece %s of partial resource is missing: %v", p.key, err)
+			return false
+		}
+		stale, matches := res.IsStale(), idx.matches(res)
+		res.Close()
+		if stale {
+			debugf("piece %s of partial resource is stale", p.key)
+			return false
+		} else if !matches {
+			debugf("piece %s of partial resource has a different validator", p.key)
+			return false
+		}
+	}
+	return true
+}
+
+// servePartial serves a Range request from stored pieces of a resource, it returns
+// false if they don't cover the requested ranges or need validation
+func (h *Handler) servePartial(w http.ResponseWriter, r *cacheRequest) bool {
+	idx, err := h.readPartialIndex(r.Key)
+	if err != nil {
+		return false
+	}
+
+	res := NewResource(http.StatusOK, &partialBody{cache: h.cache, idx: idx}, cloneHeader(idx.header))
+	defer res.Close()
+
+	if h.needsValidation(res, r) || !ifRangeMatches(r.Request, res) {
+		return false
+	}
+
+	ranges, err := parseRange(r.Header.Get("Range"), idx.size)
+	if err != nil {
+		return false
+	}
+	for _, ra := range ranges {
+		if !idx.covers(ra) {
+			return false
+		}
+	}
+
+	if !h.piecesStored(idx) {
+		debugf("dropping partial resource with missing pieces")
+		h.cache.Invalidate(append(idx.keys(), partialIndexKey(r.Key))...)
+		return false
+	}
+
+	debugf("serving range from partial resource")
+	res.Header().Set(CacheHeader, "HIT")
+	h.serveResource(res, w, r)
+	return true
+}
+
+// partialResourceWriter adds a piece to the partial index once it's committed
+type partialResourceWriter struct {
+	ResourceWriter
+	commit func() error
+}
+
+func (w *partialResourceWriter) Close() error {
+	if err := w.ResourceWriter.Close(); err != nil {
+		return err
+	}
+	return w.commit()
+}
+
+// partialBody reads a resource from its stored pieces, reading outside of
+// the pieces is an error
+type partialBody struct {
+	cache  Cache
+	idx    *partialIndex
+	offset int64
+	cur    *piece
+	res    *Resource
+}
+
+func (b *partialBody) Read(p []byte) (int, error) {
+	if b.offset >= b.idx.size {
+		return 0, io.EOF
+	}
+
+	if b.cur == nil || b.offset < b.cur.start || b.offset >= b.cur.start+b.cur.length {
+		if err := b.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	if max := b.cur.start + b.cur.length - b.offset; int64(len(p)) > max {
+		p = p[:max]
+	}
+
+	n, err := b.res.Read(p)
+	b.offset += int64(n)
+	if err == io.EOF && b.offset < b.cur.start+b.cur.length {
+		err = io.ErrUnexpectedEOF
+	} else if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// open opens the piece containing the current offset
+func (b *partialBody) open() error {
+	b.Close()
+
+	for i, p := range b.idx.pieces {
+		if b.offset >= p.start && b.offset < p.start+p.length {
+			res, err := b.cache.Retrieve(p.key)
+			if err != nil {
+				return err
+			}
+			if !b.idx.matches(res) {
+				res.Close()
+				return fmt.Errorf("piece %s has a different validator", p.key)
+			}
+			if _, err := res.Seek(b.offset-p.start, io.SeekStart); err != nil {
+				res.Close()
+				return err
+			}
+			b.cur, b.res = &b.idx.pieces[i], res
+			return nil
+		}
+	}
+
+	return fmt.Errorf("offset %d isn't in a stored piece", b.offset)
+}
+
+func (b *partialBody) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.idx.size
+	default:
+		return 0, errors.New("partialBody.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("partialBody.Seek: negative position")
+	}
+
+	if b.cur != nil && offset != b.offset {
+		b.Close()
+	}
+	b.offset = offset
+	return offset, nil
+}
+
+func (b *partialBody) Close() error {
+	var err error
+	if b.res != nil {
+		err = b.res.Close()
+	}
+	b.cur, b.res = nil, nil
+	return err
+}
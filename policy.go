@@ -0,0 +1,161 @@
+package httpcache
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"time"
+)
+
+// Policy overrides the caching decisions that a Handler makes for a request and
+// the response to it. Each method is given the decision the Handler would make
+// otherwise, and returns the one to use instead. Embed DefaultPolicy to only
+// override some decisions.
+type Policy interface {
+	// Shared returns whether the cache is shared for a response, which
+	// determines how private responses and s-maxage are treated
+	Shared(r *http.Request, res *Resource, shared bool) bool
+	// Cacheable returns whether a response can be stored. Responses with
+	// no-store, a Vary of "*", a status that isn't storeable or that are private
+	// in a shared cache are never stored, regardless of the Policy.
+	Cacheable(r *http.Request, res *Resource, cacheable bool) bool
+	// Lifetime returns how long a response is fresh for from when it was
+	// generated upstream, before the request's Cache-Control is considered
+	Lifetime(r *http.Request, res *Resource, lifetime time.Duration) time.Duration
+	// StoreHeader modifies the headers of a response before it's stored, it
+	// doesn't change the response that is served while it's stored
+	StoreHeader(r *http.Request, h http.Header)
+}
+
+// DefaultPolicy makes the same decisions as a Handler with no Policy
+type DefaultPolicy struct{}
+
+func (DefaultPolicy) Shared(r *http.Request, res *Resource, shared bool) bool {
+	return shared
+}
+
+func (DefaultPolicy) Cacheable(r *http.Request, res *Resource, cacheable bool) bool {
+	return cacheable
+}
+
+func (DefaultPolicy) Lifetime(r *http.Request, res *Resource, lifetime time.Duration) time.Duration {
+	return lifetime
+}
+
+func (DefaultPolicy) StoreHeader(r *http.Request, h http.Header) {}
+
+// Rule overrides the freshness of the responses it matches. The patterns are as
+// per path.Match, and an empty pattern or list matches anything.
+type Rule struct {
+	// Host is a pattern for the host of the request, e.g "*.example.org"
+	Host string
+	// Path is a pattern for the path of the request, e.g "/static/*.js"
+	Path string
+	// ContentType is a pattern for the media type of the response, e.g "image/*"
+	ContentType string
+	// Status is a list of response statuses
+	Status []int
+	// TTL is the lifetime of a response, regardless of its Cache-Control or
+	// Expires headers. Responses with no freshness information are cacheable.
+	TTL time.Duration
+	// MinTTL and MaxTTL limit the lifetime of a response, a MinTTL makes
+	// responses with no freshness information cacheable
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// IgnoreNoCache caches responses with a no-cache directive as if they
+	// didn't have it
+	IgnoreNoCache bool
+}
+
+// matches returns whether the rule applies to a request and its response
+func (rule Rule) matches(r *http.Request, res *Resource) bool {
+	host := r.URL.Host
+	if host == "" {
+		host = r.Host
+	}
+
+	if !patternMatches(rule.Host, canonicalHost(r.URL.Scheme, host)) ||
+		!patternMatches(rule.Path, r.URL.Path) {
+		return false
+	}
+
+	if rule.ContentType != "" {
+		mediaType, _, err := mime.ParseMediaType(res.Header().Get("Content-Type"))
+		if err != nil || !patternMatches(rule.ContentType, mediaType) {
+			return false
+		}
+	}
+
+	if len(rule.Status) == 0 {
+		return true
+	}
+	for _, status := range rule.Status {
+		if status == res.Status() {
+			return true
+		}
+	}
+	return false
+}
+
+func patternMatches(pattern, s string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, s)
+	return ok
+}
+
+// Rules is a Policy that applies the first Rule that matches a response
+type Rules []Rule
+
+func (rules Rules) match(r *http.Request, res *Resource) (Rule, bool) {
+	for _, rule := range rules {
+		if rule.matches(r, res) {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+func (rules Rules) Shared(r *http.Request, res *Resource, shared bool) bool {
+	return shared
+}
+
+func (rules Rules) Cacheable(r *http.Request, res *Resource, cacheable bool) bool {
+	rule, ok := rules.match(r, res)
+	if !ok || cacheable {
+		return cacheable
+	}
+
+	cc, err := res.cacheControl()
+	if err != nil || (cc.Has("no-cache") && !rule.IgnoreNoCache) {
+		return false
+	}
+
+	if rule.TTL > 0 || rule.MinTTL > 0 {
+		return true
+	}
+
+	return rule.IgnoreNoCache && (res.HasExplicitExpiration() || res.HasValidators())
+}
+
+func (rules Rules) Lifetime(r *http.Request, res *Resource, lifetime time.Duration) time.Duration {
+	rule, ok := rules.match(r, res)
+	if !ok {
+		return lifetime
+	}
+
+	if rule.TTL > 0 {
+		lifetime = rule.TTL
+	}
+	if lifetime < rule.MinTTL {
+		lifetime = rule.MinTTL
+	}
+	if rule.MaxTTL > 0 && lifetime > rule.MaxTTL {
+		lifetime = rule.MaxTTL
+	}
+
+	return lifetime
+}
+
+func (rules Rules) StoreHeader(r *http.Request, h http.Header) {}
@@ -0,0 +1,84 @@
+package httpcache_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lox/httpcache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRulesForceTTL(t *testing.T) {
+	client, upstream := testSetup()
+	client.cacheHandler.Policy = httpcache.Rules{
+		{Path: "/static/*", ContentType: "text/*", TTL: time.Minute},
+	}
+
+	assert.Equal(t, "MISS", client.get("/static/llamas").cacheStatus)
+	assert.Equal(t, "HIT", client.get("/static/llamas").cacheStatus)
+	assert.Equal(t, "SKIP", client.get("/llamas").cacheStatus)
+
+	upstream.timeTravel(time.Second * 90)
+	assert.Equal(t, "MISS", client.get("/static/llamas").cacheStatus)
+	assert.Equal(t, 3, upstream.requests)
+}
+
+func TestRulesIgnoreNoCache(t *testing.T) {
+	client, upstream := testSetup()
+	client.cacheHandler.Policy = httpcache.Rules{
+		{Host: "example.org", IgnoreNoCache: true},
+	}
+	upstream.CacheControl = "no-cache, max-age=60"
+
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+	assert.Equal(t, "HIT", client.get("/").cacheStatus)
+
+	upstream.CacheControl = "no-store, max-age=60"
+	assert.Equal(t, "SKIP", client.get("/no-store").cacheStatus)
+	assert.Equal(t, "SKIP", client.get("/no-store").cacheStatus)
+}
+
+func TestRulesLimitTTL(t *testing.T) {
+	client, upstream := testSetup()
+	client.cacheHandler.Policy = httpcache.Rules{
+		{Status: []int{http.StatusOK}, MaxTTL: time.Minute},
+	}
+	upstream.CacheControl = "max-age=3600"
+
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+	upstream.timeTravel(time.Second * 30)
+	assert.Equal(t, "HIT", client.get("/").cacheStatus)
+	upstream.timeTravel(time.Second * 60)
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+}
+
+type cookiePolicy struct {
+	httpcache.DefaultPolicy
+}
+
+func (cookiePolicy) Shared(r *http.Request, res *httpcache.Resource, shared bool) bool {
+	return true
+}
+
+func (cookiePolicy) StoreHeader(r *http.Request, h http.Header) {
+	h.Del("Set-Cookie")
+}
+
+func TestPolicyOverridesSharedAndStoredHeaders(t *testing.T) {
+	client, upstream := testSetup()
+	client.cacheHandler.Policy = cookiePolicy{}
+	upstream.CacheControl = "max-age=60"
+	upstream.Header.Set("Set-Cookie", "llamas=true")
+
+	r1 := client.get("/")
+	assert.Equal(t, "MISS", r1.cacheStatus)
+	assert.Equal(t, "llamas=true", r1.header.Get("Set-Cookie"))
+
+	r2 := client.get("/")
+	assert.Equal(t, "HIT", r2.cacheStatus)
+	assert.Equal(t, "", r2.header.Get("Set-Cookie"))
+
+	upstream.CacheControl = "private, max-age=60"
+	assert.Equal(t, "SKIP", client.get("/private").cacheStatus)
+}
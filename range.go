@@ -0,0 +1,351 @@
+package httpcache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errMalformedRange     = errors.New("malformed Range header")
+	errUnsatisfiableRange = errors.New("unsatisfiable Range header")
+)
+
+// httpRange is a range of bytes as per RFC 7233 §2.1
+type httpRange struct {
+	start, length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+func (r httpRange) mimeHeader(contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {r.contentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+// parseRange parses a Range header for a resource of the given size. Ranges that
+// start beyond the end of the resource are dropped, if there are none left it
+// returns errUnsatisfiableRange.
+func parseRange(s string, size int64) ([]httpRange, error) {
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		return nil, errMalformedRange
+	}
+
+	var ranges []httpRange
+	var sawSatisfiable bool
+
+	for _, ra := range strings.Split(s[len(b):], ",") {
+		ra = strings.TrimSpace(ra)
+		if ra == "" {
+			continue
+		}
+		i := strings.Index(ra, "-")
+		if i < 0 {
+			return nil, errMalformedRange
+		}
+		start, end := strings.TrimSpace(ra[:i]), strings.TrimSpace(ra[i+1:])
+
+		var r httpRange
+		if start == "" {
+			// a suffix range, the last n bytes
+			n, err := strconv.ParseInt(end, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errMalformedRange
+			}
+			if n == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r.start = size - n
+			r.length = n
+		} else {
+			i, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errMalformedRange
+			}
+			if i >= size {
+				continue
+			}
+			r.start = i
+			if end == "" {
+				r.length = size - i
+			} else {
+				j, err := strconv.ParseInt(end, 10, 64)
+				if err != nil || j < i {
+					return nil, errMalformedRange
+				}
+				if j >= size {
+					j = size - 1
+				}
+				r.length = j - i + 1
+			}
+		}
+
+		if r.length > 0 {
+			sawSatisfiable = true
+			ranges = append(ranges, r)
+		}
+	}
+
+	if !sawSatisfiable {
+		return nil, errUnsatisfiableRange
+	}
+	return ranges, nil
+}
+
+// ifRangeMatches returns whether the If-Range header of a request, if any, matches
+// a resource. Only strong validators match, as per RFC 7233 §3.2.
+func ifRangeMatches(r *http.Request, res *Resource) bool {
+	ifRange := r.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		t, err := ParseEntityTag(ifRange)
+		if err != nil {
+			return false
+		}
+		etag, err := ParseEntityTag(res.Header().Get("Etag"))
+		return err == nil && t.StrongMatch(etag)
+	}
+
+	t, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+
+	lastModified, ok := strongLastModified(res.Header())
+	return ok && lastModified.Equal(t)
+}
+
+// strongLastModified returns the Last-Modified of a response if it's a strong
+// validator, which is only when it's at least a second before the Date as per
+// RFC 7232 §2.2.2
+func strongLastModified(h http.Header) (time.Time, bool) {
+	lastModified, err := timeHeader("Last-Modified", h)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if date, err := timeHeader("Date", h); err != nil || date.Sub(lastModified) < time.Second {
+		return time.Time{}, false
+	}
+	return lastModified, true
+}
+
+// serveRanges serves the parts of a resource in the Range header of a request,
+// it returns false if the Range header doesn't apply and the whole resource
+// should be served instead
+func (h *Handler) serveRanges(res *Resource, w http.ResponseWriter, req *cacheRequest) bool {
+	rangeHeader := req.Header.Get("Range")
+	if rangeHeader == "" || res.Status() != http.StatusOK || !ifRangeMatches(req.Request, res) {
+		return false
+	}
+
+	size, err := res.Seek(0, io.SeekEnd)
+	if err != nil {
+		http.Error(w, "Error seeking resource: "+err.Error(),
+			http.StatusInternalServerError)
+		return true
+	}
+
+	ranges, err := parseRange(rangeHeader, size)
+	if err == errMalformedRange {
+		debugf("ignoring malformed Range %q", rangeHeader)
+		res.Seek(0, io.SeekStart)
+		return false
+	} else if err == errUnsatisfiableRange {
+		w.Header().Del("Content-Type")
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return true
+	}
+
+	if len(ranges) == 1 {
+		ra := ranges[0]
+		w.Header().Set("Content-Range", ra.contentRange(size))
+		w.Header().Set("Content-Length", strconv.FormatInt(ra.length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+
+		if req.Method != "HEAD" {
+			if _, err := res.Seek(ra.start, io.SeekStart); err != nil {
+				errorf("Error seeking resource: %s", err.Error())
+			} else if _, err := io.CopyN(w, res, ra.length); err != nil {
+				errorf("Error serving range: %s", err.Error())
+			}
+		}
+		return true
+	}
+
+	contentType := w.Header().Get("Content-Type")
+	boundary := multipart.NewWriter(ioutil.Discard).Boundary()
+
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+	w.Header().Set("Content-Length", strconv.FormatInt(
+		multipartLength(boundary, ranges, contentType, size), 10))
+	w.WriteHeader(http.StatusPartialContent)
+
+	if req.Method == "HEAD" {
+		return true
+	}
+
+	mw := multipart.NewWriter(w)
+	mw.SetBoundary(boundary)
+	for _, ra := range ranges {
+		part, err := mw.CreatePart(ra.mimeHeader(contentType, size))
+		if err != nil {
+			return true
+		}
+		if _, err := res.Seek(ra.start, io.SeekStart); err != nil {
+			return true
+		}
+		if _, err := io.CopyN(part, res, ra.length); err != nil {
+			return true
+		}
+	}
+	mw.Close()
+	return true
+}
+
+// multipartLength returns the length of a multipart/byteranges body
+func multipartLength(boundary string, ranges []httpRange, contentType string, size int64) int64 {
+	var w countingWriter
+	mw := multipart.NewWriter(&w)
+	mw.SetBoundary(boundary)
+
+	var length int64
+	for _, ra := range ranges {
+		mw.CreatePart(ra.mimeHeader(contentType, size))
+		length += ra.length
+	}
+	mw.Close()
+
+	return length + int64(w)
+}
+
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// fillWriter is used to fetch a whole resource upstream to satisfy a Range
+// request. The body is passed through as it streams, with a single range sliced
+// out of it if its length is known, so that the range is served while the whole
+// resource is stored. Otherwise the whole resource is served.
+type fillWriter struct {
+	http.ResponseWriter
+	r      *http.Request
+	ra     *httpRange
+	offset int64
+}
+
+func (w *fillWriter) WriteHeader(status int) {
+	if status == http.StatusOK && ifRangeMatches(w.r, NewResource(status, nil, w.Header())) {
+		size, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64)
+		if err == nil {
+			if ranges, err := parseRange(w.r.Header.Get("Range"), size); err == nil && len(ranges) == 1 {
+				w.ra = &ranges[0]
+				w.Header().Set("Content-Range", w.ra.contentRange(size))
+				w.Header().Set("Content-Length", strconv.FormatInt(w.ra.length, 10))
+				status = http.StatusPartialContent
+			}
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *fillWriter) Write(b []byte) (int, error) {
+	if w.ra == nil {
+		return w.ResponseWriter.Write(b)
+	}
+
+	// only write the part of b that is within the range
+	pos := w.offset
+	w.offset += int64(len(b))
+
+	start, end := w.ra.start-pos, w.ra.start+w.ra.length-pos
+	if start < 0 {
+		start = 0
+	}
+	if end > int64(len(b)) {
+		end = int64(len(b))
+	}
+	if start < end {
+		if _, err := w.ResponseWriter.Write(b[start:end]); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (w *fillWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// fetchWholeRange returns whether a Range request starts within RangeOffsetLimit
+func (h *Handler) fetchWholeRange(r *cacheRequest) bool {
+	if h.RangeOffsetLimit < 0 {
+		return true
+	}
+
+	// suffix ranges start too far in to be within any limit
+	ranges, err := parseRange(r.Header.Get("Range"), math.MaxInt64)
+	if err != nil {
+		return false
+	}
+	for _, ra := range ranges {
+		if ra.start >= h.RangeOffsetLimit {
+			return false
+		}
+	}
+	return true
+}
+
+// fetchUpstream passes a request upstream and stores the result, as per
+// passUpstream. A Range request is served from stored pieces of the resource if
+// possible. Otherwise, if it's within RangeOffsetLimit, it's made without its
+// Range so that the whole resource can be stored, with the range sliced out of
+// the response as it's passed through.
+func (h *Handler) fetchUpstream(w http.ResponseWriter, r *cacheRequest, f *flight) {
+	if r.Header.Get("Range") == "" {
+		h.passUpstream(w, r, f, nil)
+		return
+	}
+
+	if h.servePartial(w, r) {
+		h.flights.finish(f, false)
+		return
+	}
+
+	if !h.fetchWholeRange(r) {
+		h.passUpstream(w, r, f, nil)
+		return
+	}
+
+	req := cloneRequest(r.Request)
+	req.Header.Del("Range")
+	req.Header.Del("If-Range")
+
+	debugf("fetching whole resource upstream for Range request")
+	h.passUpstream(&fillWriter{ResponseWriter: w, r: r.Request}, r.withRequest(req), f, nil)
+}
@@ -0,0 +1,95 @@
+package httpcache
+
+import (
+	"bufio"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Fields stored in a header record alongside the headers of the resource,
+// they are removed again when the record is read
+const (
+	// bodyLengthField is the length of the body the record was written with,
+	// so that a body that doesn't belong to it can be detected
+	bodyLengthField = "X-Httpcache-Body-Length"
+
+	// staleField is the time the resource was invalidated
+	staleField = "X-Httpcache-Stale"
+)
+
+// Record is what a Cache stores for each key besides the body, the headers of
+// the resource with the length of its body and when it was invalidated. It's
+// exported for Cache implementations outside of this package.
+type Record struct {
+	Header
+	// BodyLength is the length of the body the record was written with, so
+	// that a body that doesn't belong to it can be detected. It's -1 if the
+	// record doesn't have one.
+	BodyLength int64
+	// Stale is when the resource was invalidated, if it has been
+	Stale time.Time
+}
+
+// ReadRecord reads a record in the format written by Bytes
+func ReadRecord(r *bufio.Reader) (Record, error) {
+	h, err := readHeaders(r)
+	if err != nil {
+		return Record{}, err
+	}
+
+	rec := Record{Header: h, BodyLength: -1}
+	if l, err := strconv.ParseInt(h.Get(bodyLengthField), 10, 64); err == nil {
+		rec.BodyLength = l
+	}
+	if t, err := time.Parse(time.RFC3339Nano, h.Get(staleField)); err == nil {
+		rec.Stale = t
+	}
+	h.Del(bodyLengthField)
+	h.Del(staleField)
+
+	return rec, nil
+}
+
+// Bytes returns the status line and headers of the record, including its
+// fields. Both are always set, replacing any header of the same name that the
+// response was sent with.
+func (rec Record) Bytes() []byte {
+	h := cloneHeader(rec.Header.Header)
+	h.Set(bodyLengthField, strconv.FormatInt(rec.BodyLength, 10))
+	if rec.Stale.IsZero() {
+		h.Set(staleField, "")
+	} else {
+		h.Set(staleField, rec.Stale.Format(time.RFC3339Nano))
+	}
+	return encodeHeader(rec.StatusCode, h)
+}
+
+// Resource returns a Resource for the record with the given body, marked as
+// stale if it was invalidated after it was stored
+func (rec Record) Resource(body ReadSeekCloser) *Resource {
+	res := NewResource(rec.StatusCode, body, rec.Header.Header)
+	if !rec.Stale.IsZero() && !res.DateAfter(rec.Stale) {
+		log.Printf("stale marker of %s found", rec.Stale)
+		res.MarkStale()
+	}
+	return res
+}
+
+// Invalidate marks the record as stale
+func (rec *Record) Invalidate() {
+	rec.Stale = Clock()
+}
+
+// Freshen replaces the headers of the record with those of a resource with the
+// same status and validators, as per Cache.Freshen. Otherwise the record is
+// invalidated, and it returns false.
+func (rec *Record) Freshen(res *Resource) bool {
+	if rec.StatusCode != res.Status() || !headersEqual(rec.Header.Header, res.Header()) {
+		rec.Invalidate()
+		return false
+	}
+
+	rec.Header = Header{Header: res.Header(), StatusCode: rec.StatusCode}
+	return true
+}
@@ -81,13 +81,8 @@ func (r *Resource) cacheControl() (CacheControl, error) {
 		return r.cc, nil
 	}
 
-	cc, err := ParseCacheControlHeaders(r.header)
-	if err != nil {
-		return cc, err
-	}
-
-	r.cc = cc
-	return cc, nil
+	r.cc = parseCacheControlLenient(strings.Join(r.header["Cache-Control"], ", "))
+	return r.cc, nil
 }
 
 func (r *Resource) LastModified() time.Time {
@@ -113,7 +108,7 @@ func (r *Resource) Expires() (time.Time, error) {
 func (r *Resource) MustValidate(shared bool) bool {
 	cc, err := r.cacheControl()
 	if err != nil {
-		debugf("Error parsing Cache-Control: ", err.Error())
+		debugf("Error parsing Cache-Control: %s", err.Error())
 		return true
 	}
 
@@ -198,7 +193,7 @@ func (r *Resource) RemovePrivateHeaders() {
 		debugf("Error parsing Cache-Control: %s", err.Error())
 	}
 
-	for _, p := range cc["private"] {
+	for _, p := range fieldNames(cc["private"]) {
 		debugf("removing private header %q", p)
 		r.header.Del(p)
 	}
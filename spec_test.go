@@ -1,10 +1,14 @@
 package httpcache_test
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"strconv"
 	"testing"
 	"time"
 
@@ -53,6 +57,7 @@ func TestSpecResponseCacheControl(t *testing.T) {
 		requests       int
 		secondsElapsed time.Duration
 		shared         bool
+		etag           string
 	}{
 		{cacheControl: "", requests: 2},
 		{cacheControl: "no-cache", requests: 2, cacheStatus: "SKIP"},
@@ -60,14 +65,14 @@ func TestSpecResponseCacheControl(t *testing.T) {
 		{cacheControl: "max-age=0, no-cache", requests: 2, cacheStatus: "SKIP"},
 		{cacheControl: "max-age=0", requests: 2, cacheStatus: "SKIP"},
 		{cacheControl: "s-maxage=0", requests: 2, cacheStatus: "SKIP", shared: true},
-		{cacheControl: "s-maxage=60", requests: 2, cacheStatus: "HIT", shared: true},
+		{cacheControl: "s-maxage=60", requests: 2, cacheStatus: "HIT", shared: true, etag: `"llamas"`},
 		{cacheControl: "s-maxage=60", requests: 2, secondsElapsed: 65, shared: true},
 		{cacheControl: "max-age=60", requests: 1, cacheStatus: "HIT"},
 		{cacheControl: "max-age=60", requests: 1, secondsElapsed: 35, cacheStatus: "HIT"},
 		{cacheControl: "max-age=60", requests: 2, secondsElapsed: 65},
-		{cacheControl: "max-age=60, must-revalidate", requests: 2, cacheStatus: "HIT"},
+		{cacheControl: "max-age=60, must-revalidate", requests: 2, cacheStatus: "HIT", etag: `"llamas"`},
 		{cacheControl: "max-age=60, proxy-revalidate", requests: 1, cacheStatus: "HIT"},
-		{cacheControl: "max-age=60, proxy-revalidate", requests: 2, cacheStatus: "HIT", shared: true},
+		{cacheControl: "max-age=60, proxy-revalidate", requests: 2, cacheStatus: "HIT", shared: true, etag: `"llamas"`},
 		{cacheControl: "private, max-age=60", requests: 1, cacheStatus: "HIT"},
 		{cacheControl: "private, max-age=60", requests: 2, cacheStatus: "SKIP", shared: true},
 	}
@@ -75,6 +80,7 @@ func TestSpecResponseCacheControl(t *testing.T) {
 	for idx, c := range cases {
 		client, upstream := testSetup()
 		upstream.CacheControl = c.cacheControl
+		upstream.Etag = c.etag
 		client.cacheHandler.Shared = c.shared
 
 		assert.Equal(t, http.StatusOK, client.get("/").Code)
@@ -159,6 +165,9 @@ func TestSpecRequestCacheControl(t *testing.T) {
 		{cacheControl: "max-age=30", requests: 2, secondsElapsed: 40},
 		{cacheControl: "min-fresh=5", requests: 1},
 		{cacheControl: "min-fresh=120", requests: 2},
+		{cacheControl: "max-age = 0", requests: 2},
+		{cacheControl: `no-cache="Set-Cookie`, requests: 2},
+		{cacheControl: "max-age=60;", requests: 1},
 	}
 
 	for idx, c := range cases {
@@ -226,6 +235,95 @@ func TestSpecConditionalCaching(t *testing.T) {
 	assert.Equal(t, "HIT", r2.cacheStatus)
 }
 
+func TestSpecConditionalRequestsUseWeakComparison(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Etag = `W/"llamas"`
+
+	r1 := client.get("/")
+	assert.Equal(t, "MISS", r1.cacheStatus)
+
+	r2 := client.get("/", `If-None-Match: "alpacas", "llamas"`)
+	assert.Equal(t, http.StatusNotModified, r2.Code)
+	assert.Equal(t, "HIT", r2.cacheStatus)
+	assert.Equal(t, `W/"llamas"`, r2.header.Get("Etag"))
+	assert.Equal(t, "", string(r2.body))
+
+	r3 := client.get("/", `If-Match: W/"llamas"`)
+	assert.Equal(t, http.StatusPreconditionFailed, r3.Code)
+	assert.Equal(t, "HIT", r3.cacheStatus)
+	assert.Equal(t, "", string(r3.body))
+	assert.Equal(t, 1, upstream.requests)
+}
+
+func TestSpecConditionalRequestsUseStrongComparisonForIfMatch(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Etag = `"llamas"`
+
+	r1 := client.get("/")
+	assert.Equal(t, "MISS", r1.cacheStatus)
+
+	r2 := client.get("/", `If-Match: "alpacas", "llamas"`)
+	assert.Equal(t, http.StatusOK, r2.Code)
+	assert.Equal(t, "HIT", r2.cacheStatus)
+	assert.Equal(t, "llamas", string(r2.body))
+
+	r3 := client.get("/", `If-Match: "alpacas"`)
+	assert.Equal(t, http.StatusPreconditionFailed, r3.Code)
+	assert.Equal(t, "HIT", r3.cacheStatus)
+
+	r4 := client.get("/", `If-Match: *`)
+	assert.Equal(t, http.StatusOK, r4.Code)
+	assert.Equal(t, 1, upstream.requests)
+}
+
+func TestSpecConditionalRequestsWithDates(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.LastModified = upstream.Now.Add(-time.Hour)
+
+	r1 := client.get("/")
+	assert.Equal(t, "MISS", r1.cacheStatus)
+
+	r2 := client.get("/", "If-Modified-Since: "+upstream.LastModified.Format(http.TimeFormat))
+	assert.Equal(t, http.StatusNotModified, r2.Code)
+	assert.Equal(t, "HIT", r2.cacheStatus)
+
+	r3 := client.get("/", "If-Modified-Since: "+upstream.LastModified.Add(-time.Second).Format(http.TimeFormat))
+	assert.Equal(t, http.StatusOK, r3.Code)
+	assert.Equal(t, "llamas", string(r3.body))
+
+	r4 := client.get("/", "If-Unmodified-Since: "+upstream.LastModified.Add(-time.Second).Format(http.TimeFormat))
+	assert.Equal(t, http.StatusPreconditionFailed, r4.Code)
+	assert.Equal(t, "HIT", r4.cacheStatus)
+
+	r5 := client.get("/", "If-Unmodified-Since: "+upstream.LastModified.Format(http.TimeFormat))
+	assert.Equal(t, http.StatusOK, r5.Code)
+	assert.Equal(t, 1, upstream.requests)
+}
+
+func TestSpecConditionalRequestsForNonOKStatus(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.StatusCode = http.StatusNotFound
+	upstream.Etag = `"missing"`
+
+	r1 := client.get("/")
+	assert.Equal(t, http.StatusNotFound, r1.Code)
+	assert.Equal(t, "MISS", r1.cacheStatus)
+
+	r2 := client.get("/", `If-None-Match: "missing"`)
+	assert.Equal(t, http.StatusNotModified, r2.Code)
+	assert.Equal(t, "HIT", r2.cacheStatus)
+	assert.Equal(t, "", string(r2.body))
+
+	r3 := client.get("/", `If-Match: "found"`)
+	assert.Equal(t, http.StatusPreconditionFailed, r3.Code)
+	assert.Equal(t, "HIT", r3.cacheStatus)
+	assert.Equal(t, 1, upstream.requests)
+}
+
 func TestSpecRangeRequests(t *testing.T) {
 	client, upstream := testSetup()
 
@@ -235,6 +333,162 @@ func TestSpecRangeRequests(t *testing.T) {
 	assert.Equal(t, string(upstream.Body[0:4]), string(r1.body))
 }
 
+func TestSpecRangeRequestMissFetchesWholeResource(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.assert(func(r *http.Request) {
+		assert.Equal(t, "", r.Header.Get("Range"))
+	})
+
+	r1 := client.get("/", "Range: bytes=0-3")
+	assert.Equal(t, http.StatusPartialContent, r1.Code)
+	assert.Equal(t, "MISS", r1.cacheStatus)
+	assert.Equal(t, "bytes 0-3/6", r1.header.Get("Content-Range"))
+	assert.Equal(t, "llam", string(r1.body))
+
+	r2 := client.get("/", "Range: bytes=2-")
+	assert.Equal(t, http.StatusPartialContent, r2.Code)
+	assert.Equal(t, "HIT", r2.cacheStatus)
+	assert.Equal(t, "amas", string(r2.body))
+
+	r3 := client.get("/")
+	assert.Equal(t, http.StatusOK, r3.Code)
+	assert.Equal(t, "llamas", string(r3.body))
+	assert.Equal(t, 1, upstream.requests)
+}
+
+func TestSpecRangeRequestsFromCache(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Header.Set("Content-Type", "text/plain")
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+
+	r1 := client.get("/", "Range: bytes=-2")
+	assert.Equal(t, http.StatusPartialContent, r1.Code)
+	assert.Equal(t, "bytes 4-5/6", r1.header.Get("Content-Range"))
+	assert.Equal(t, "as", string(r1.body))
+
+	r2 := client.get("/", "Range: bytes=0-1, 4-")
+	assert.Equal(t, http.StatusPartialContent, r2.Code)
+	assert.Equal(t, strconv.Itoa(len(r2.body)), r2.header.Get("Content-Length"))
+
+	_, params, err := mime.ParseMediaType(r2.header.Get("Content-Type"))
+	require.NoError(t, err)
+	mr := multipart.NewReader(bytes.NewReader(r2.body), params["boundary"])
+	for _, expected := range []string{"ll", "as"} {
+		part, err := mr.NextPart()
+		require.NoError(t, err)
+		assert.Equal(t, "text/plain", part.Header.Get("Content-Type"))
+		assert.Equal(t, expected, readAllString(part))
+	}
+
+	r3 := client.get("/", "Range: bytes=10-")
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, r3.Code)
+	assert.Equal(t, "bytes */6", r3.header.Get("Content-Range"))
+
+	r4 := client.get("/", "Range: llamas")
+	assert.Equal(t, http.StatusOK, r4.Code)
+	assert.Equal(t, "llamas", string(r4.body))
+	assert.Equal(t, 1, upstream.requests)
+}
+
+func TestSpecRangeRequestsWithIfRange(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Etag = `"llamas"`
+	upstream.LastModified = upstream.Now.Add(-time.Hour)
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+
+	r1 := client.get("/", "Range: bytes=0-3", `If-Range: "llamas"`)
+	assert.Equal(t, http.StatusPartialContent, r1.Code)
+	assert.Equal(t, "llam", string(r1.body))
+
+	r2 := client.get("/", "Range: bytes=0-3", `If-Range: "alpacas"`)
+	assert.Equal(t, http.StatusOK, r2.Code)
+	assert.Equal(t, "llamas", string(r2.body))
+
+	r3 := client.get("/", "Range: bytes=0-3", `If-Range: W/"llamas"`)
+	assert.Equal(t, http.StatusOK, r3.Code)
+
+	r4 := client.get("/", "Range: bytes=0-3",
+		"If-Range: "+upstream.LastModified.Format(http.TimeFormat))
+	assert.Equal(t, http.StatusPartialContent, r4.Code)
+	assert.Equal(t, 1, upstream.requests)
+}
+
+func TestSpecPartialResponsesAreCombined(t *testing.T) {
+	client, upstream := testSetup()
+	client.cacheHandler.RangeOffsetLimit = 0
+	upstream.CacheControl = "max-age=60"
+	upstream.Etag = `"llamas"`
+
+	r1 := client.get("/", "Range: bytes=0-1")
+	assert.Equal(t, http.StatusPartialContent, r1.Code)
+	assert.Equal(t, "MISS", r1.cacheStatus)
+	assert.Equal(t, "ll", string(r1.body))
+
+	r2 := client.get("/", "Range: bytes=0-1")
+	assert.Equal(t, http.StatusPartialContent, r2.Code)
+	assert.Equal(t, "HIT", r2.cacheStatus)
+	assert.Equal(t, "ll", string(r2.body))
+
+	assert.Equal(t, "MISS", client.get("/", "Range: bytes=2-3").cacheStatus)
+
+	r3 := client.get("/", "Range: bytes=1-3")
+	assert.Equal(t, "HIT", r3.cacheStatus)
+	assert.Equal(t, "bytes 1-3/6", r3.header.Get("Content-Range"))
+	assert.Equal(t, "lam", string(r3.body))
+
+	assert.Equal(t, "MISS", client.get("/", "Range: bytes=4-5").cacheStatus)
+	assert.Equal(t, 3, upstream.requests)
+
+	r4 := client.get("/")
+	assert.Equal(t, http.StatusOK, r4.Code)
+	assert.Equal(t, "HIT", r4.cacheStatus)
+	assert.Equal(t, "llamas", string(r4.body))
+	assert.Equal(t, 3, upstream.requests)
+}
+
+func TestSpecPartialResponsesWithDifferentValidatorsAreNotCombined(t *testing.T) {
+	client, upstream := testSetup()
+	client.cacheHandler.RangeOffsetLimit = 0
+	upstream.CacheControl = "max-age=60"
+	upstream.Etag = `"llamas"`
+	assert.Equal(t, "MISS", client.get("/", "Range: bytes=0-2").cacheStatus)
+
+	upstream.Etag = `"alpacas"`
+	upstream.Body = []byte("alpaca")
+	assert.Equal(t, "MISS", client.get("/", "Range: bytes=3-5").cacheStatus)
+
+	r := client.get("/")
+	assert.Equal(t, "MISS", r.cacheStatus)
+	assert.Equal(t, "alpaca", string(r.body))
+}
+
+func TestSpecPartialResponsesNeedStrongValidators(t *testing.T) {
+	client, upstream := testSetup()
+	client.cacheHandler.RangeOffsetLimit = 0
+	upstream.CacheControl = "max-age=60"
+	upstream.Etag = `W/"llamas"`
+
+	assert.Equal(t, "SKIP", client.get("/", "Range: bytes=0-2").cacheStatus)
+	assert.Equal(t, "SKIP", client.get("/", "Range: bytes=0-2").cacheStatus)
+	assert.Equal(t, 2, upstream.requests)
+}
+
+func TestSpecUnsafeMethodsInvalidatePartialResponses(t *testing.T) {
+	client, upstream := testSetup()
+	client.cacheHandler.RangeOffsetLimit = 0
+	upstream.CacheControl = "max-age=60"
+	upstream.Etag = `"llamas"`
+	assert.Equal(t, "MISS", client.get("/", "Range: bytes=0-2").cacheStatus)
+	assert.Equal(t, "HIT", client.get("/", "Range: bytes=0-2").cacheStatus)
+
+	client.post("/")
+	assert.Equal(t, "MISS", client.get("/", "Range: bytes=0-2").cacheStatus)
+	assert.Equal(t, 3, upstream.requests)
+}
+
 func TestSpecHeuristicCaching(t *testing.T) {
 	client, upstream := testSetup()
 	upstream.LastModified = upstream.Now.AddDate(-1, 0, 0)
@@ -320,6 +574,62 @@ func TestSpecValidatingStaleResponsesUnchanged(t *testing.T) {
 	assert.Equal(t, http.StatusOK, r2.Code)
 	assert.Equal(t, string(upstream.Body), string(r2.body))
 	assert.Equal(t, "HIT", r2.cacheStatus)
+	assert.Equal(t, "1", r2.header.Get("X-New-Header"))
+	assert.Equal(t, 2, upstream.requests)
+}
+
+func TestSpecValidatingMergesHeadersFromNotModified(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Etag = `"llamas"`
+	upstream.Header.Set("X-Version", "1")
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+
+	upstream.timeTravel(time.Second * 90)
+	upstream.CacheControl = "max-age=120"
+	upstream.Header.Set("X-Version", "2")
+	upstream.Header.Set("Connection", "X-Hop")
+	upstream.Header.Set("X-Hop", "1")
+	upstream.Header.Set("Keep-Alive", "timeout=5")
+
+	r2 := client.get("/")
+	assert.Equal(t, http.StatusOK, r2.Code)
+	assert.Equal(t, "HIT", r2.cacheStatus)
+	assert.Equal(t, "llamas", string(r2.body))
+	assert.Equal(t, "6", r2.header.Get("Content-Length"))
+	assert.Equal(t, "2", r2.header.Get("X-Version"))
+	assert.Equal(t, "max-age=120", r2.header.Get("Cache-Control"))
+	assert.Equal(t, "", r2.header.Get("X-Hop"))
+	assert.Equal(t, "", r2.header.Get("Keep-Alive"))
+
+	upstream.timeTravel(time.Second * 90)
+	r3 := client.get("/")
+	assert.Equal(t, "HIT", r3.cacheStatus)
+	assert.Equal(t, "2", r3.header.Get("X-Version"))
+	assert.Equal(t, 2, upstream.requests)
+}
+
+func TestSpecValidatingUpdatesAllMatchingVariants(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Vary = "Accept-Language"
+	upstream.Etag = `"llamas"`
+
+	assert.Equal(t, "MISS", client.get("/", "Accept-Language: en").cacheStatus)
+	assert.Equal(t, "MISS", client.get("/", "Accept-Language: de").cacheStatus)
+
+	upstream.timeTravel(time.Second * 90)
+	upstream.Header.Set("X-Version", "2")
+
+	r1 := client.get("/", "Accept-Language: en")
+	assert.Equal(t, "HIT", r1.cacheStatus)
+	assert.Equal(t, 3, upstream.requests)
+
+	r2 := client.get("/", "Accept-Language: de")
+	assert.Equal(t, "HIT", r2.cacheStatus)
+	assert.Equal(t, "2", r2.header.Get("X-Version"))
+	assert.Equal(t, "", r2.header.Get("Warning"))
+	assert.Equal(t, 3, upstream.requests)
 }
 
 func TestSpecValidatingStaleResponsesWithNewContent(t *testing.T) {
@@ -335,6 +645,11 @@ func TestSpecValidatingStaleResponsesWithNewContent(t *testing.T) {
 	assert.Equal(t, "MISS", r2.cacheStatus)
 	assert.Equal(t, "brand new content", string(r2.body))
 	assert.Equal(t, time.Duration(0), r2.age)
+	assert.Equal(t, 2, upstream.requests)
+
+	r3 := client.get("/")
+	assert.Equal(t, "HIT", r3.cacheStatus)
+	assert.Equal(t, "brand new content", string(r3.body))
 }
 
 func TestSpecValidatingStaleResponsesWithNewEtag(t *testing.T) {
@@ -352,6 +667,65 @@ func TestSpecValidatingStaleResponsesWithNewEtag(t *testing.T) {
 	assert.Equal(t, "MISS", r2.cacheStatus)
 }
 
+func TestSpecValidatingSendsUnparseableEtag(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Etag = "llamas1"
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+
+	upstream.timeTravel(time.Second * 90)
+	upstream.assert(func(r *http.Request) {
+		if upstream.requests == 2 {
+			assert.Equal(t, "llamas1", r.Header.Get("If-None-Match"))
+		}
+	})
+
+	assert.Equal(t, "HIT", client.get("/").cacheStatus)
+	assert.Equal(t, 2, upstream.requests)
+}
+
+func TestSpecValidatingStaleResponsesWithWeakenedEtag(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Etag = `"llamas"`
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+
+	upstream.timeTravel(time.Second * 90)
+	upstream.Etag = `W/"llamas"`
+
+	r2 := client.get("/")
+	assert.Equal(t, http.StatusOK, r2.Code)
+	assert.Equal(t, "HIT", r2.cacheStatus)
+	assert.Equal(t, string(upstream.Body), string(r2.body))
+}
+
+func TestSpecValidatingSelectsVariantByEtag(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Vary = "Accept-Language"
+
+	for _, lang := range []string{"en", "de"} {
+		upstream.Etag = `"` + lang + `"`
+		upstream.Body = []byte("llamas in " + lang)
+		assert.Equal(t, "MISS", client.get("/", "Accept-Language: "+lang).cacheStatus)
+	}
+
+	upstream.timeTravel(time.Second * 90)
+	upstream.Etag = `"en"`
+	upstream.assert(func(r *http.Request) {
+		tags, err := httpcache.ParseEntityTags(r.Header.Get("If-None-Match"))
+		assert.NoError(t, err)
+		assert.Len(t, tags, 2)
+	})
+
+	r := client.get("/", "Accept-Language: de")
+	assert.Equal(t, http.StatusOK, r.Code)
+	assert.Equal(t, "HIT", r.cacheStatus)
+	assert.Equal(t, `"en"`, r.header.Get("Etag"))
+	assert.Equal(t, "llamas in en", string(r.body))
+	assert.Equal(t, 3, upstream.requests)
+}
+
 func TestSpecVaryHeader(t *testing.T) {
 	client, upstream := testSetup()
 	upstream.CacheControl = "max-age=60"
@@ -364,6 +738,75 @@ func TestSpecVaryHeader(t *testing.T) {
 	assert.Equal(t, "HIT", client.get("/", "Accept-Language: de").cacheStatus)
 }
 
+func TestSpecVaryStoresMultipleVariants(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Vary = "accept-language,  Accept-Encoding"
+
+	for _, lang := range []string{"en", "de", "fr"} {
+		upstream.Body = []byte("llamas in " + lang)
+		assert.Equal(t, "MISS", client.get("/", "Accept-Language: "+lang).cacheStatus)
+	}
+
+	for _, lang := range []string{"en", "de", "fr"} {
+		r := client.get("/", "Accept-Language: "+lang)
+		assert.Equal(t, "HIT", r.cacheStatus)
+		assert.Equal(t, "llamas in "+lang, string(r.body))
+	}
+
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+	assert.Equal(t, 4, upstream.requests)
+}
+
+func TestSpecVaryNormalizesHeaderValues(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Vary = "Accept-Encoding"
+
+	assert.Equal(t, "MISS", client.get("/", "Accept-Encoding: gzip, deflate").cacheStatus)
+	assert.Equal(t, "HIT", client.get("/", "Accept-Encoding: gzip,deflate").cacheStatus)
+	assert.Equal(t, "HIT", client.get("/", "Accept-Encoding: gzip ,  deflate").cacheStatus)
+	assert.Equal(t, "MISS", client.get("/", "Accept-Encoding: deflate, gzip").cacheStatus)
+}
+
+func TestSpecVaryStarNeverMatches(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Vary = "*"
+
+	assert.Equal(t, "SKIP", client.get("/").cacheStatus)
+	assert.Equal(t, "SKIP", client.get("/").cacheStatus)
+	assert.Equal(t, 2, upstream.requests)
+}
+
+func TestSpecVaryInvalidationDropsAllVariants(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Vary = "Accept-Language"
+
+	assert.Equal(t, "MISS", client.get("/", "Accept-Language: en").cacheStatus)
+	assert.Equal(t, "MISS", client.get("/", "Accept-Language: de").cacheStatus)
+
+	client.post("/")
+
+	assert.Equal(t, "MISS", client.get("/", "Accept-Language: en").cacheStatus)
+	assert.Equal(t, "HIT", client.get("/", "Accept-Language: en").cacheStatus)
+	assert.Equal(t, "MISS", client.get("/", "Accept-Language: de").cacheStatus)
+}
+
+func TestSpecVaryReplacedByUnvariedResource(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Vary = "Accept-Language"
+	assert.Equal(t, "MISS", client.get("/", "Accept-Language: en").cacheStatus)
+
+	upstream.Vary = ""
+	upstream.Body = []byte("llamas for everyone")
+	upstream.timeTravel(time.Second * 65)
+	assert.Equal(t, "MISS", client.get("/", "Accept-Language: en").cacheStatus)
+	assert.Equal(t, "HIT", client.get("/", "Accept-Language: de").cacheStatus)
+}
+
 func TestSpecHeadersPropagated(t *testing.T) {
 	client, upstream := testSetup()
 	upstream.CacheControl = "max-age=60"
@@ -483,3 +926,346 @@ func TestSpecMultipleCacheControlHeaders(t *testing.T) {
 	r1 := client.get("/")
 	assert.Equal(t, "SKIP", r1.cacheStatus)
 }
+
+func TestSpecStaleWhileRevalidate(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60, stale-while-revalidate=30"
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+
+	upstream.timeTravel(time.Second * 70)
+	upstream.Body = []byte("brand new content")
+
+	r2 := client.get("/")
+	assert.Equal(t, "HIT", r2.cacheStatus)
+	assert.Equal(t, "llamas", string(r2.body))
+	assert.Equal(t, []string{`110 - "Response is Stale"`}, r2.Header()["Warning"])
+	assert.Equal(t, 2, upstream.requests, "stale response should be revalidated in the background")
+
+	r3 := client.get("/")
+	assert.Equal(t, "HIT", r3.cacheStatus)
+	assert.Equal(t, "brand new content", string(r3.body))
+	assert.Empty(t, r3.Header()["Warning"])
+	assert.Equal(t, 2, upstream.requests)
+}
+
+func TestSpecStaleWhileRevalidateUnchanged(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60, stale-while-revalidate=30"
+	upstream.Etag = `"llamas"`
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+
+	upstream.timeTravel(time.Second * 70)
+	assert.Equal(t, "HIT", client.get("/").cacheStatus)
+	assert.Equal(t, 2, upstream.requests)
+
+	r3 := client.get("/")
+	assert.Equal(t, "HIT", r3.cacheStatus)
+	assert.Empty(t, r3.Header()["Warning"])
+	assert.Equal(t, 2, upstream.requests)
+}
+
+func TestSpecStaleWhileRevalidateExpired(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60, stale-while-revalidate=30"
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+
+	upstream.timeTravel(time.Second * 100)
+	upstream.Body = []byte("brand new content")
+
+	r2 := client.get("/")
+	assert.Equal(t, "MISS", r2.cacheStatus)
+	assert.Equal(t, "brand new content", string(r2.body))
+}
+
+func TestSpecStaleIfError(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60, stale-if-error=60"
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+
+	upstream.timeTravel(time.Second * 90)
+	upstream.StatusCode = http.StatusInternalServerError
+	upstream.Body = []byte("upstream failed")
+
+	r2 := client.get("/")
+	assert.Equal(t, http.StatusOK, r2.statusCode)
+	assert.Equal(t, "STALE", r2.cacheStatus)
+	assert.Equal(t, "llamas", string(r2.body))
+	assert.Contains(t, r2.Header()["Warning"], `111 - "Revalidation Failed"`)
+
+	upstream.timeTravel(time.Second * 60)
+	r3 := client.get("/")
+	assert.Equal(t, http.StatusInternalServerError, r3.statusCode)
+	assert.Equal(t, "upstream failed", string(r3.body))
+}
+
+func TestSpecStaleIfErrorInRequest(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+
+	upstream.timeTravel(time.Second * 90)
+	upstream.StatusCode = http.StatusServiceUnavailable
+
+	assert.Equal(t, http.StatusServiceUnavailable, client.get("/").statusCode)
+
+	r2 := client.get("/", cc("stale-if-error=60"))
+	assert.Equal(t, http.StatusOK, r2.statusCode)
+	assert.Equal(t, "STALE", r2.cacheStatus)
+	assert.Equal(t, "llamas", string(r2.body))
+}
+
+func TestSpecStaleIfErrorDefault(t *testing.T) {
+	client, upstream := testSetup()
+	client.cacheHandler.StaleIfError = time.Minute
+	upstream.CacheControl = "max-age=60"
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+
+	upstream.timeTravel(time.Second * 90)
+	upstream.StatusCode = http.StatusBadGateway
+
+	r2 := client.get("/")
+	assert.Equal(t, http.StatusOK, r2.statusCode)
+	assert.Equal(t, "STALE", r2.cacheStatus)
+
+	r3 := client.get("/", cc("stale-if-error=0"))
+	assert.Equal(t, http.StatusBadGateway, r3.statusCode)
+}
+
+func TestSpecStaleIfErrorWithMustRevalidate(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60, must-revalidate, stale-if-error=60"
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+
+	upstream.timeTravel(time.Second * 90)
+	upstream.StatusCode = http.StatusInternalServerError
+
+	assert.Equal(t, http.StatusInternalServerError, client.get("/").statusCode)
+}
+
+func TestSpecStaleIfErrorWithNewContent(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60, stale-if-error=60"
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+
+	upstream.timeTravel(time.Second * 90)
+	upstream.Body = []byte("brand new content")
+
+	r2 := client.get("/")
+	assert.Equal(t, 2, upstream.requests)
+	assert.Equal(t, http.StatusOK, r2.statusCode)
+	assert.Equal(t, "MISS", r2.cacheStatus)
+	assert.Equal(t, "brand new content", string(r2.body))
+}
+
+func TestSpecStaleIfErrorWhenRefetchFails(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60, stale-if-error=60"
+	upstream.Etag = `"llamas"`
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+
+	upstream.timeTravel(time.Second * 90)
+	upstream.assert(func(r *http.Request) {
+		switch upstream.requests {
+		case 2:
+			// a 304 that doesn't select the stored response
+			upstream.StatusCode = http.StatusNotModified
+			upstream.Etag = `"alpacas"`
+		case 3:
+			upstream.StatusCode = http.StatusBadGateway
+		}
+	})
+
+	r2 := client.get("/")
+	assert.Equal(t, 3, upstream.requests)
+	assert.Equal(t, http.StatusOK, r2.statusCode)
+	assert.Equal(t, "STALE", r2.cacheStatus)
+	assert.Equal(t, "llamas", string(r2.body))
+}
+
+func TestSpecOfflineMode(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+
+	upstream.timeTravel(time.Hour * 24)
+	client.cacheHandler.SetOffline(true)
+
+	r2 := client.get("/", cc("no-cache"))
+	assert.Equal(t, http.StatusOK, r2.statusCode)
+	assert.Equal(t, "HIT", r2.cacheStatus)
+	assert.Equal(t, "llamas", string(r2.body))
+	assert.Contains(t, r2.Header()["Warning"], `112 - "Disconnected Operation"`)
+	assert.Equal(t, 1, upstream.requests)
+
+	assert.Equal(t, http.StatusGatewayTimeout, client.get("/missing").statusCode)
+	client.cacheHandler.OfflineStatus = http.StatusServiceUnavailable
+	assert.Equal(t, http.StatusServiceUnavailable, client.get("/missing").statusCode)
+	assert.Equal(t, 1, upstream.requests)
+
+	client.cacheHandler.SetOffline(false)
+	assert.Equal(t, http.StatusOK, client.get("/").statusCode)
+	assert.Equal(t, 2, upstream.requests, "stale resource should be validated once back online")
+}
+
+func TestSpecUnsafeMethodsInvalidate(t *testing.T) {
+	for _, method := range []string{"POST", "PUT", "DELETE", "PATCH"} {
+		client, upstream := testSetup()
+		upstream.CacheControl = "max-age=3600"
+		assert.Equal(t, "MISS", client.get("/llamas").cacheStatus)
+		assert.Equal(t, "HIT", client.get("/llamas").cacheStatus)
+		assert.Equal(t, "HIT", client.head("/llamas").cacheStatus)
+
+		upstream.Body = []byte("brand new llamas")
+		client.do(newRequest(method, "http://example.org/llamas"))
+
+		r := client.get("/llamas")
+		assert.Equal(t, "MISS", r.cacheStatus, method)
+		assert.Equal(t, "brand new llamas", string(r.body), method)
+	}
+}
+
+func TestSpecUnsafeMethodsErrorsDontInvalidate(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=3600"
+	assert.Equal(t, "MISS", client.get("/llamas").cacheStatus)
+
+	upstream.StatusCode = http.StatusInternalServerError
+	client.post("/llamas")
+
+	upstream.StatusCode = http.StatusOK
+	assert.Equal(t, "HIT", client.get("/llamas").cacheStatus)
+}
+
+func TestSpecUnsafeMethodsInvalidateLocations(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=3600"
+	for _, path := range []string{"/location", "/content-location", "/elsewhere"} {
+		assert.Equal(t, "MISS", client.get(path).cacheStatus)
+	}
+
+	upstream.Body = []byte("brand new llamas")
+	upstream.Header.Set("Location", "/location")
+	upstream.Header.Set("Content-Location", "http://example.org/content-location")
+	client.post("/llamas")
+
+	upstream.Header = http.Header{}
+	upstream.Header.Set("Location", "http://example.com/elsewhere")
+	client.post("/llamas")
+	upstream.Header = http.Header{}
+
+	assert.Equal(t, "MISS", client.get("/location").cacheStatus)
+	assert.Equal(t, "MISS", client.get("/content-location").cacheStatus)
+	assert.Equal(t, "HIT", client.get("/elsewhere").cacheStatus)
+}
+
+func TestSpecUnsafeMethodsInvalidateVariants(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=3600"
+	upstream.Vary = "Accept"
+	assert.Equal(t, "MISS", client.get("/llamas", "Accept: text/plain").cacheStatus)
+	assert.Equal(t, "HIT", client.get("/llamas", "Accept: text/plain").cacheStatus)
+
+	upstream.Body = []byte("brand new llamas")
+	client.put("/llamas")
+
+	r := client.get("/llamas", "Accept: text/plain")
+	assert.Equal(t, "MISS", r.cacheStatus)
+	assert.Equal(t, "brand new llamas", string(r.body))
+}
+
+func TestSpecQueryOptionsNormalizeKeys(t *testing.T) {
+	client, upstream := testSetup()
+	client.cacheHandler.QueryOptions = httpcache.QueryOptions{
+		Sort:   true,
+		Ignore: []string{"utm_*", "_"},
+	}
+	upstream.CacheControl = "max-age=60"
+
+	assert.Equal(t, "MISS", client.get("/test?a=1&b=2").cacheStatus)
+	assert.Equal(t, "HIT", client.get("/test?b=2&a=1").cacheStatus)
+	assert.Equal(t, "HIT", client.get("/test?utm_source=x&a=1&_=12345&b=2").cacheStatus)
+	assert.Equal(t, "MISS", client.get("/test?a=2&b=1").cacheStatus)
+
+	client.post("/test?b=2&utm_medium=y&a=1")
+	assert.Equal(t, "MISS", client.get("/test?a=1&b=2").cacheStatus)
+	assert.Equal(t, 4, upstream.requests)
+}
+
+func TestSpecKeyFunc(t *testing.T) {
+	client, upstream := testSetup()
+	client.cacheHandler.KeyFunc = func(r *http.Request) httpcache.Key {
+		return httpcache.NewRequestKey(r).Extend(r.Header.Get("X-Tenant"))
+	}
+	upstream.CacheControl = "max-age=60"
+
+	assert.Equal(t, "MISS", client.get("/test", "X-Tenant: a").cacheStatus)
+	assert.Equal(t, "MISS", client.get("/test", "X-Tenant: b").cacheStatus)
+	assert.Equal(t, "HIT", client.get("/test", "X-Tenant: a").cacheStatus)
+	assert.Equal(t, "HIT", client.head("/test", "X-Tenant: b").cacheStatus)
+	assert.Equal(t, "MISS", client.head("/test", "X-Tenant: c").cacheStatus)
+
+	client.post("/test", "X-Tenant: a")
+	assert.Equal(t, "MISS", client.get("/test", "X-Tenant: a").cacheStatus)
+	assert.Equal(t, "HIT", client.get("/test", "X-Tenant: b").cacheStatus)
+	assert.Equal(t, 5, upstream.requests)
+}
+
+func TestSpecNegativeCaching(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.StatusCode = http.StatusNotFound
+
+	assert.Equal(t, "SKIP", client.get("/missing").cacheStatus)
+	assert.Equal(t, "SKIP", client.get("/missing").cacheStatus)
+
+	client.cacheHandler.NegativeTTL = time.Second * 30
+	assert.Equal(t, "MISS", client.get("/missing").cacheStatus)
+	r := client.get("/missing")
+	assert.Equal(t, "HIT", r.cacheStatus)
+	assert.Equal(t, http.StatusNotFound, r.statusCode)
+
+	upstream.timeTravel(time.Second * 40)
+	assert.Equal(t, "MISS", client.get("/missing").cacheStatus)
+
+	upstream.CacheControl = "max-age=60"
+	upstream.timeTravel(time.Second * 40)
+	assert.Equal(t, "MISS", client.get("/missing").cacheStatus)
+	upstream.timeTravel(time.Second * 40)
+	assert.Equal(t, "HIT", client.get("/missing").cacheStatus)
+	assert.Equal(t, 5, upstream.requests)
+}
+
+func TestSpecErrorCaching(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.StatusCode = http.StatusServiceUnavailable
+	upstream.CacheControl = "stale-if-error=3600"
+
+	assert.Equal(t, "SKIP", client.get("/").cacheStatus)
+
+	client.cacheHandler.ErrorTTL = time.Second * 5
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+	r := client.get("/")
+	assert.Equal(t, "HIT", r.cacheStatus)
+	assert.Equal(t, http.StatusServiceUnavailable, r.statusCode)
+
+	upstream.timeTravel(time.Second * 10)
+	assert.Equal(t, "MISS", client.get("/").cacheStatus)
+	assert.Equal(t, 3, upstream.requests)
+}
+
+func TestSpecStoreableStatuses(t *testing.T) {
+	client, upstream := testSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.StatusCode = http.StatusInternalServerError
+
+	assert.Equal(t, "SKIP", client.get("/error").cacheStatus)
+
+	client.cacheHandler.Storeable[http.StatusInternalServerError] = true
+	delete(client.cacheHandler.Storeable, http.StatusOK)
+
+	assert.Equal(t, "MISS", client.get("/error").cacheStatus)
+	assert.Equal(t, "HIT", client.get("/error").cacheStatus)
+
+	upstream.StatusCode = http.StatusOK
+	assert.Equal(t, "SKIP", client.get("/ok").cacheStatus)
+	assert.Equal(t, "SKIP", client.get("/ok").cacheStatus)
+}
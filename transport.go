@@ -0,0 +1,178 @@
+package httpcache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// Transport is a http.RoundTripper that caches responses for a client, with the
+// same freshness, validation, Vary and invalidation logic as Handler. Responses
+// are marked as cache hits or misses with the CacheHeader.
+type Transport struct {
+	// Handler makes the caching decisions, its options can be changed before
+	// the Transport is used
+	Handler *Handler
+}
+
+// NewTransport returns a Transport that stores responses in a Cache and makes
+// requests with a RoundTripper, or http.DefaultTransport if it's nil
+func NewTransport(cache Cache, rt http.RoundTripper) *Transport {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &Transport{Handler: NewHandler(cache, &roundTripHandler{rt})}
+}
+
+// RoundTrip serves a request from the cache if possible, otherwise it's made
+// with the underlying RoundTripper. An error making the request is returned,
+// unless a stale response can be served in its place.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	upstreamErr := &roundTripError{}
+	req = req.WithContext(context.WithValue(req.Context(), roundTripErrorKey, upstreamErr))
+
+	cReq, err := t.Handler.newCacheRequest(req)
+	if err != nil {
+		closeBody(req)
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	w := &pipeResponseWriter{
+		header: http.Header{},
+		req:    req,
+		body:   pr,
+		pw:     pw,
+		result: make(chan roundTripResult, 1),
+	}
+
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				err := fmt.Errorf("httpcache: panic serving %s: %v", req.URL, p)
+				w.fail(err)
+				pw.CloseWithError(err)
+			}
+		}()
+
+		t.Handler.serveRequest(w, cReq)
+		w.WriteHeader(http.StatusOK)
+		pw.Close()
+
+		// RoundTrip has to close the body, even if the request wasn't made
+		closeBody(req)
+	}()
+
+	result := <-w.result
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	resp := result.resp
+	if upstreamErr.err != nil && resp.StatusCode == http.StatusBadGateway {
+		resp.Body.Close()
+		return nil, upstreamErr.err
+	}
+	return resp, nil
+}
+
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+type contextKey string
+
+const roundTripErrorKey = contextKey("httpcache.roundTripError")
+
+// roundTripError holds an error from the underlying RoundTripper of a Transport,
+// which the Handler sees as a 502 response
+type roundTripError struct {
+	err error
+}
+
+// roundTripHandler is the upstream http.Handler of a Transport, it makes requests
+// with a http.RoundTripper
+type roundTripHandler struct {
+	rt http.RoundTripper
+}
+
+func (h *roundTripHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	resp, err := h.rt.RoundTrip(r)
+	if err != nil {
+		if holder, ok := r.Context().Value(roundTripErrorKey).(*roundTripError); ok {
+			holder.err = err
+		}
+		// the error isn't from upstream, so it mustn't be cached as one
+		w.Header().Set("Cache-Control", "no-store")
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for key, headers := range resp.Header {
+		w.Header()[key] = headers
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+type roundTripResult struct {
+	resp *http.Response
+	err  error
+}
+
+// pipeResponseWriter is a http.ResponseWriter that turns what the Handler writes
+// into a *http.Response, with the body streamed through a pipe
+type pipeResponseWriter struct {
+	header      http.Header
+	req         *http.Request
+	body        io.ReadCloser
+	pw          *io.PipeWriter
+	result      chan roundTripResult
+	wroteHeader bool
+}
+
+func (w *pipeResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *pipeResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        cloneHeader(w.header),
+		Body:          w.body,
+		ContentLength: -1,
+		Request:       w.req,
+	}
+	if l, err := strconv.ParseInt(w.header.Get("Content-Length"), 10, 64); err == nil {
+		resp.ContentLength = l
+	}
+
+	w.result <- roundTripResult{resp: resp}
+}
+
+func (w *pipeResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.pw.Write(b)
+}
+
+// fail returns an error from RoundTrip if the response hasn't been started
+func (w *pipeResponseWriter) fail(err error) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.result <- roundTripResult{err: err}
+	}
+}
@@ -0,0 +1,111 @@
+package httpcache_test
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lox/httpcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func transportSetup() (*httpcache.Transport, *upstreamServer) {
+	_, upstream := testSetup()
+	return httpcache.NewTransport(httpcache.NewMemoryCache(), upstream), upstream
+}
+
+func roundTrip(t *testing.T, transport http.RoundTripper, method, url string, headers ...string) (*http.Response, string) {
+	resp, err := transport.RoundTrip(newRequest(method, url, headers...))
+	require.NoError(t, err)
+	body := readAllString(resp.Body)
+	resp.Body.Close()
+	httpcache.Writes.Wait()
+	return resp, body
+}
+
+func TestTransportServesFromCache(t *testing.T) {
+	transport, upstream := transportSetup()
+	upstream.CacheControl = "max-age=60"
+
+	r1, body := roundTrip(t, transport, "GET", "http://example.org/")
+	assert.Equal(t, http.StatusOK, r1.StatusCode)
+	assert.Equal(t, "MISS", r1.Header.Get(httpcache.CacheHeader))
+	assert.Equal(t, "llamas", body)
+
+	r2, body := roundTrip(t, transport, "GET", "http://example.org/")
+	assert.Equal(t, http.StatusOK, r2.StatusCode)
+	assert.Equal(t, "HIT", r2.Header.Get(httpcache.CacheHeader))
+	assert.Equal(t, int64(6), r2.ContentLength)
+	assert.Equal(t, "llamas", body)
+
+	r3, _ := roundTrip(t, transport, "GET", "http://example.com/")
+	assert.Equal(t, "MISS", r3.Header.Get(httpcache.CacheHeader))
+	assert.Equal(t, 2, upstream.requests)
+}
+
+func TestTransportValidatesStaleResponses(t *testing.T) {
+	transport, upstream := transportSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Etag = `"llamas"`
+
+	roundTrip(t, transport, "GET", "http://example.org/")
+	upstream.timeTravel(time.Second * 90)
+
+	r2, body := roundTrip(t, transport, "GET", "http://example.org/")
+	assert.Equal(t, http.StatusOK, r2.StatusCode)
+	assert.Equal(t, "HIT", r2.Header.Get(httpcache.CacheHeader))
+	assert.Equal(t, "llamas", body)
+	assert.Equal(t, 2, upstream.requests)
+}
+
+func TestTransportVaryAndInvalidation(t *testing.T) {
+	transport, upstream := transportSetup()
+	upstream.CacheControl = "max-age=60"
+	upstream.Vary = "Accept-Language"
+
+	r1, _ := roundTrip(t, transport, "GET", "http://example.org/", "Accept-Language: en")
+	assert.Equal(t, "MISS", r1.Header.Get(httpcache.CacheHeader))
+	r2, _ := roundTrip(t, transport, "GET", "http://example.org/", "Accept-Language: de")
+	assert.Equal(t, "MISS", r2.Header.Get(httpcache.CacheHeader))
+	r3, _ := roundTrip(t, transport, "GET", "http://example.org/", "Accept-Language: en")
+	assert.Equal(t, "HIT", r3.Header.Get(httpcache.CacheHeader))
+
+	roundTrip(t, transport, "POST", "http://example.org/")
+
+	r4, _ := roundTrip(t, transport, "GET", "http://example.org/", "Accept-Language: en")
+	assert.Equal(t, "MISS", r4.Header.Get(httpcache.CacheHeader))
+	assert.Equal(t, 4, upstream.requests)
+}
+
+type failingTransport struct {
+	http.RoundTripper
+	err error
+}
+
+func (t *failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
+func TestTransportReturnsUpstreamErrors(t *testing.T) {
+	_, upstream := testSetup()
+	upstream.CacheControl = "max-age=60, stale-if-error=60"
+	failing := &failingTransport{RoundTripper: upstream}
+	transport := httpcache.NewTransport(httpcache.NewMemoryCache(), failing)
+
+	roundTrip(t, transport, "GET", "http://example.org/stale")
+
+	failing.err = errors.New("connection refused")
+	_, err := transport.RoundTrip(newRequest("GET", "http://example.org/missing"))
+	assert.Equal(t, failing.err, err)
+
+	upstream.timeTravel(time.Second * 90)
+	r, body := roundTrip(t, transport, "GET", "http://example.org/stale")
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	assert.Equal(t, "STALE", r.Header.Get(httpcache.CacheHeader))
+	assert.Equal(t, "llamas", body)
+}
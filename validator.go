@@ -1,41 +1,193 @@
 package httpcache
 
 import (
-	"fmt"
 	"net/http"
-	"net/http/httptest"
+	"strings"
 )
 
 type Validator struct {
 	Handler http.Handler
 }
 
-func (v *Validator) Validate(req *http.Request, res *Resource) bool {
+// request returns a conditional request for validating the stored variants of a
+// resource, with the entity-tags of all of them so that upstream can select any
+func (v *Validator) request(req *http.Request, variants []*Resource) *http.Request {
 	outreq := cloneRequest(req)
-	resHeaders := res.Header()
 
-	if etag := resHeaders.Get("Etag"); etag != "" {
-		outreq.Header.Set("If-None-Match", etag)
-	} else if lastMod := resHeaders.Get("Last-Modified"); lastMod != "" {
+	// the preconditions of the client are evaluated against the cached resource
+	for _, header := range conditionalHeaders {
+		outreq.Header.Del(header)
+	}
+
+	var etags EntityTags
+	var unparsed []string
+	for _, res := range variants {
+		value := res.Header().Get("Etag")
+		if etag, err := ParseEntityTag(value); err == nil {
+			if !etags.WeakMatch(etag) {
+				etags = append(etags, etag)
+			}
+		} else if value != "" {
+			// entity-tags that can't be parsed are sent as they are, in case
+			// upstream understands them
+			unparsed = append(unparsed, value)
+		}
+	}
+
+	var ifNoneMatch []string
+	if len(etags) > 0 {
+		ifNoneMatch = append(ifNoneMatch, etags.String())
+	}
+	ifNoneMatch = append(ifNoneMatch, unparsed...)
+
+	if len(ifNoneMatch) > 0 {
+		outreq.Header.Set("If-None-Match", strings.Join(ifNoneMatch, ", "))
+	} else if lastMod := variants[0].Header().Get("Last-Modified"); lastMod != "" {
 		outreq.Header.Set("If-Modified-Since", lastMod)
 	}
 
-	t := Clock()
-	resp := httptest.NewRecorder()
-	v.Handler.ServeHTTP(resp, outreq)
-	resp.Flush()
+	return outreq
+}
+
+// unchanged returns whether a full response is the same as one of the stored
+// variants, which it is if it has the same status and strong entity-tag. This
+// validates the variants when upstream ignores the If-None-Match, as it can
+// for an entity-tag that can't be parsed.
+func unchanged(status int, header http.Header, variants []*Resource) bool {
+	etag := header.Get("Etag")
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		return false
+	}
 
-	if age, err := correctedAge(resp.HeaderMap, t, Clock()); err == nil {
-		resp.Header().Set("Age", fmt.Sprintf("%.f", age.Seconds()))
+	for _, res := range variants {
+		if res.Status() == status && res.Header().Get("Etag") == etag {
+			return true
+		}
 	}
+	return false
+}
+
+// notModified selects the stored variants that a 304 response applies to and
+// updates their headers with it, as per RFC 7234 §4.3.4. It returns the
+// selected variants, which are none if the 304 doesn't match any of them.
+func notModified(header http.Header, variants []*Resource) []*Resource {
+	selected := selectVariants(header, variants)
 
-	if headersEqual(resHeaders, resp.HeaderMap) {
-		res.header = resp.HeaderMap
+	for _, res := range selected {
+		res.header = updateHeader(res.Header(), header)
 		res.header.Set(ProxyDateHeader, Clock().Format(http.TimeFormat))
-		return true
 	}
 
-	return false
+	return selected
+}
+
+// selectVariants returns the stored variants identified by the validator in the
+// headers of a 304 response
+func selectVariants(header http.Header, variants []*Resource) []*Resource {
+	var selected []*Resource
+
+	if etag, err := ParseEntityTag(header.Get("Etag")); err == nil {
+		for _, res := range variants {
+			stored, err := ParseEntityTag(res.Header().Get("Etag"))
+			if err == nil && (stored.StrongMatch(etag) || (etag.Weak && stored.WeakMatch(etag))) {
+				selected = append(selected, res)
+			}
+		}
+		// all variants with a strong validator, or the most recent with a weak one
+		if etag.Weak {
+			return mostRecent(selected)
+		}
+		return selected
+	}
+
+	if value := header.Get("Etag"); value != "" {
+		// an entity-tag that can't be parsed only matches the same value
+		for _, res := range variants {
+			if res.Header().Get("Etag") == value {
+				selected = append(selected, res)
+			}
+		}
+		return mostRecent(selected)
+	}
+
+	if lastMod := header.Get("Last-Modified"); lastMod != "" {
+		for _, res := range variants {
+			if res.Header().Get("Last-Modified") == lastMod {
+				selected = append(selected, res)
+			}
+		}
+		return mostRecent(selected)
+	}
+
+	// without a validator the response can only apply to a single variant
+	if len(variants) == 1 {
+		return variants
+	}
+	return nil
+}
+
+// mostRecent returns the variant with the latest Date, if there are any
+func mostRecent(variants []*Resource) []*Resource {
+	if len(variants) == 0 {
+		return nil
+	}
+
+	latest := variants[0]
+	for _, res := range variants[1:] {
+		if t, err := timeHeader("Date", latest.Header()); err == nil && res.DateAfter(t) {
+			latest = res
+		}
+	}
+	return []*Resource{latest}
+}
+
+// hopByHopHeaders are only meaningful for a single connection, as per RFC 7230 §6.1
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// updateHeader returns stored headers updated with the headers of a 304 or HEAD
+// response, as per RFC 7234 §4.3.4. Warnings with a 1xx code are removed and
+// every other header in the response replaces the stored one, except for the
+// Content-Length and hop-by-hop headers.
+func updateHeader(stored, updated http.Header) http.Header {
+	h := cloneHeader(stored)
+
+	var warnings []string
+	for _, warning := range h["Warning"] {
+		if !strings.HasPrefix(warning, "1") {
+			warnings = append(warnings, warning)
+		}
+	}
+	h.Del("Warning")
+	if len(warnings) > 0 {
+		h["Warning"] = warnings
+	}
+
+	skip := map[string]bool{"Content-Length": true}
+	for _, header := range hopByHopHeaders {
+		skip[header] = true
+	}
+	for _, connection := range updated["Connection"] {
+		for _, header := range strings.Split(connection, ",") {
+			skip[http.CanonicalHeaderKey(strings.TrimSpace(header))] = true
+		}
+	}
+
+	for key, values := range updated {
+		if !skip[http.CanonicalHeaderKey(key)] {
+			h[http.CanonicalHeaderKey(key)] = append([]string(nil), values...)
+		}
+	}
+
+	return h
 }
 
 var validationHeaders = []string{"ETag", "Content-MD5", "Last-Modified", "Content-Length"}
@@ -43,7 +195,7 @@ var validationHeaders = []string{"ETag", "Content-MD5", "Last-Modified", "Conten
 func headersEqual(h1, h2 http.Header) bool {
 	for _, header := range validationHeaders {
 		if value := h2.Get(header); value != "" {
-			if h1.Get(header) != value {
+			if !headerEqual(header, h1.Get(header), value) {
 				debugf("%s changed, %q != %q", header, value, h1.Get(header))
 				return false
 			}
@@ -53,6 +205,19 @@ func headersEqual(h1, h2 http.Header) bool {
 	return true
 }
 
+// headerEqual compares the values of a validation header, entity-tags are compared
+// with the weak comparison function as per RFC 7234 §4.3.4
+func headerEqual(header, v1, v2 string) bool {
+	if header == "ETag" {
+		t1, err1 := ParseEntityTag(v1)
+		t2, err2 := ParseEntityTag(v2)
+		if err1 == nil && err2 == nil {
+			return t1.WeakMatch(t2)
+		}
+	}
+	return v1 == v2
+}
+
 // cloneRequest returns a clone of the provided *http.Request.
 // The clone is a shallow copy of the struct and its Header map.
 func cloneRequest(r *http.Request) *http.Request {
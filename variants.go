@@ -0,0 +1,142 @@
+package httpcache
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// variantIndex lists the variants stored for a primary key, for resources that
+// have a Vary header. It's stored in the cache alongside the variants, a stale
+// index is treated as empty so that invalidating it drops all of the variants.
+type variantIndex []variant
+
+// variant is a stored resource and the headers that it varies on
+type variant struct {
+	headers []string
+	key     string
+}
+
+// variantIndexKey returns the cache key that the variant index for a key is stored under
+func variantIndexKey(k Key) string {
+	return k.String() + "::variants"
+}
+
+// readVariantIndex reads the variant index for a key, or returns ErrNotFoundInCache
+// if there isn't one or it has been invalidated
+func (h *Handler) readVariantIndex(k Key) (variantIndex, error) {
+	res, err := h.cache.Retrieve(variantIndexKey(k))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	if res.IsStale() {
+		return nil, ErrNotFoundInCache
+	}
+
+	return parseVariantIndex(res)
+}
+
+// storeVariant adds a variant to the index for a key, the index is locked while
+// it's read and stored again so that concurrent variants aren't lost
+func (h *Handler) storeVariant(k Key, headers []string, key string) error {
+	unlock := h.indexLocks.lock(variantIndexKey(k))
+	defer unlock()
+
+	index, err := h.readVariantIndex(k)
+	if err != nil && err != ErrNotFoundInCache {
+		return err
+	}
+
+	index = index.add(variant{headers: headers, key: key})
+
+	res := NewResourceBytes(http.StatusOK, index.bytes(), http.Header{
+		"Date": []string{Clock().Format(http.TimeFormat)},
+	})
+	return h.cache.Store(res, variantIndexKey(k))
+}
+
+// variantKeys returns the keys of the other variants stored alongside a key, from
+// the variant index for the request or for the GET request it may be served from
+func (h *Handler) variantKeys(r *cacheRequest, key string) []string {
+	for _, k := range []Key{r.Key, h.methodKey(r, "GET")} {
+		index, err := h.readVariantIndex(k)
+		if err != nil {
+			continue
+		}
+
+		var keys []string
+		var found bool
+		for _, v := range index {
+			if v.key == key {
+				found = true
+			} else {
+				keys = append(keys, v.key)
+			}
+		}
+		if found {
+			return keys
+		}
+	}
+
+	return nil
+}
+
+// match returns the keys of the variants in the index that match a request
+func (index variantIndex) match(k Key, r *http.Request) []string {
+	var keys []string
+
+	for _, v := range index {
+		if k.Vary(strings.Join(v.headers, ", "), r).String() == v.key {
+			keys = append(keys, v.key)
+		}
+	}
+
+	return keys
+}
+
+// add returns the index with a variant added, replacing any with the same key
+func (index variantIndex) add(v variant) variantIndex {
+	added := variantIndex{v}
+
+	for _, existing := range index {
+		if existing.key != v.key {
+			added = append(added, existing)
+		}
+	}
+
+	return added
+}
+
+// bytes serializes the index as one variant per line, with the headers it varies
+// on separated from its key by a tab
+func (index variantIndex) bytes() []byte {
+	b := &bytes.Buffer{}
+
+	for _, v := range index {
+		fmt.Fprintf(b, "%s\t%s\n", strings.Join(v.headers, ","), v.key)
+	}
+
+	return b.Bytes()
+}
+
+func parseVariantIndex(r io.Reader) (variantIndex, error) {
+	var index variantIndex
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+
+	for scanner.Scan() {
+		f := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(f) != 2 {
+			return nil, fmt.Errorf("malformed variant index line: %q", scanner.Text())
+		}
+		index = append(index, variant{headers: strings.Split(f[0], ","), key: f[1]})
+	}
+
+	return index, scanner.Err()
+}